@@ -0,0 +1,192 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// backupPagesPerStep is how many pages are copied by each step of a backup,
+// between which other connections may use the source database.
+const backupPagesPerStep = 256
+
+// backupMaxRestarts is how many times a backup may be restarted,
+// by writes to the source, before it gives up.
+const backupMaxRestarts = 8
+
+// backupMinDelay and backupMaxDelay bound the pause between steps of
+// a backup, which doubles each time it is restarted, so that writers
+// may finish.
+const (
+	backupMinDelay = time.Millisecond
+	backupMaxDelay = time.Second
+)
+
+// ErrBackupBusy is returned by Backup when the source database is written
+// too often for the copy to complete. Checkpoint, which holds off writers
+// while it copies, may be used instead.
+var ErrBackupBusy = errors.New("collysqlite: database too busy to back up")
+
+// BackupProgress reports the progress of a backup.
+type BackupProgress struct {
+	// Path is the database being backed up.
+	Path string
+	// Remaining is the number of pages still to be copied, of Total.
+	Remaining int
+	Total     int
+}
+
+// backupDatabase copies the database at srcPath to destPath, reporting
+// progress to progress, if not nil. The copy is made in steps, between
+// which other connections may read and write the database.
+func backupDatabase(ctx context.Context, srcPath, destPath string, progress func(BackupProgress)) error {
+	err := ensurePathExists(destPath)
+	if err != nil {
+		return err
+	}
+	var fn func(remaining, total int)
+	if progress != nil {
+		fn = func(remaining, total int) {
+			progress(BackupProgress{Path: srcPath, Remaining: remaining, Total: total})
+		}
+	}
+	return copyDatabaseFile(ctx, destPath, srcPath, fn)
+}
+
+// Backup copies every component database to new files, named as for
+// NewStorage(destPath), reporting progress to progress, if not nil.
+// Each database is copied consistently, but, unlike Checkpoint, they may
+// be copied at different points in time. It is safe to call while the
+// storage is in use, but returns ErrBackupBusy if a database is written
+// too often for its copy to complete.
+func (s *Storage) Backup(destPath string, progress func(BackupProgress)) error {
+	return s.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (s *Storage) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	err := s.ExplodingCookieJar.Jar.FlushContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, path := range s.databasePaths() {
+		dest := destPath + "-" + filepath.Base(path)
+		if strings.HasPrefix(path, s.Path) {
+			dest = destPath + path[len(s.Path):]
+		}
+		err := backupDatabase(ctx, path, dest, progress)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rawConn calls fn with the SQLite connection underlying c.
+func rawConn(c *sql.Conn, fn func(*sqlite3.SQLiteConn) error) error {
+	return c.Raw(func(dc interface{}) error {
+		sc, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("collysqlite: not an SQLite connection: %T", dc)
+		}
+		return fn(sc)
+	})
+}
+
+// openConn opens a single connection to the database at path,
+// which must be closed by calling closeConn.
+func openConn(ctx context.Context, path string) (c *sql.Conn, closeConn func(), err error) {
+	db, err := sqlx.ConnectContext(ctx, "sqlite3", path)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err = db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return c, func() { c.Close(); db.Close() }, nil
+}
+
+// copyDatabase replaces the contents of the main database of dst
+// with those of src, using SQLite's online backup API, in steps of
+// a bounded number of pages, so that writers are never held off for long.
+// Writes to src by other connections restart the copy, and it returns
+// ErrBackupBusy if it is restarted more than backupMaxRestarts times.
+// Progress is reported to progress, if not nil, after each step.
+func copyDatabase(ctx context.Context, dst, src *sql.Conn, progress func(remaining, total int)) error {
+	return rawConn(src, func(s *sqlite3.SQLiteConn) error {
+		return rawConn(dst, func(d *sqlite3.SQLiteConn) error {
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return err
+			}
+			restarts := 0
+			last := -1
+			delay := backupMinDelay
+			for {
+				done, err := b.Step(backupPagesPerStep)
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				remaining := b.Remaining()
+				if progress != nil {
+					progress(remaining, b.PageCount())
+				}
+				if done {
+					break
+				}
+				err = ctx.Err()
+				if err != nil {
+					b.Finish()
+					return err
+				}
+				// The backup restarts if the source is written by another
+				// connection. Back off, so that writers may finish.
+				if last >= 0 && remaining >= last {
+					restarts++
+					if restarts > backupMaxRestarts {
+						b.Finish()
+						return ErrBackupBusy
+					}
+					delay *= 2
+					if delay > backupMaxDelay {
+						delay = backupMaxDelay
+					}
+				}
+				last = remaining
+				// Let other connections make progress.
+				select {
+				case <-ctx.Done():
+					b.Finish()
+					return ctx.Err()
+				case <-time.After(delay):
+				}
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// copyDatabaseFile is like copyDatabase, for the databases at the given paths.
+func copyDatabaseFile(ctx context.Context, dstPath, srcPath string, progress func(remaining, total int)) error {
+	src, closeSrc, err := openConn(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer closeSrc()
+	dst, closeDst, err := openConn(ctx, dstPath)
+	if err != nil {
+		return err
+	}
+	defer closeDst()
+	return copyDatabase(ctx, dst, src, progress)
+}
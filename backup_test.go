@@ -0,0 +1,117 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Backup", func() {
+
+	// fill fills c with enough data to be backed up in several steps.
+	fill := func(c *collysqlite.Cache) []byte {
+		data := make([]byte, 4096)
+		for i := 0; i < 500; i++ {
+			Expect(c.Put("http://example.org/"+strconv.Itoa(i), data)).To(BeNil())
+		}
+		return data
+	}
+
+	// write calls c.Put repeatedly, pausing for pause between calls,
+	// until stop is closed.
+	write := func(wg *sync.WaitGroup, c *collysqlite.Cache, data []byte, pause time.Duration, stop chan struct{}) {
+		wg.Add(1)
+		go func() {
+			defer GinkgoRecover()
+			defer wg.Done()
+			for i := 500; ; i++ {
+				select {
+				case <-stop:
+					return
+				case <-time.After(pause):
+				}
+				Expect(c.Put("http://example.org/"+strconv.Itoa(i), data)).To(BeNil())
+				_, err := c.Get("http://example.org/1")
+				Expect(err).To(BeNil())
+			}
+		}()
+	}
+
+	It("should Backup a store while it is in use", func() {
+		c := collysqlite.NewCache("test-db-" + randomName())
+		Expect(c.Init()).To(BeNil())
+		defer c.Destroy()
+		data := fill(c)
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		write(&wg, c, data, 20*time.Millisecond, stop)
+
+		var last collysqlite.BackupProgress
+		calls := 0
+		dest := collysqlite.NewCache("test-db-" + randomName())
+		err := c.Backup(dest.Path, func(p collysqlite.BackupProgress) {
+			last = p
+			calls++
+		})
+		close(stop)
+		wg.Wait()
+		Expect(err).To(BeNil())
+		defer dest.Destroy()
+		Expect(calls).To(BeNumerically(">", 1))
+		Expect(last.Path).To(Equal(c.Path))
+		Expect(last.Remaining).To(Equal(0))
+		Expect(last.Total).To(BeNumerically(">", 0))
+
+		got, err := dest.Get("http://example.org/499")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal(data))
+	})
+
+	It("should give up a Backup of a store that is always being written", func() {
+		c := collysqlite.NewCache("test-db-" + randomName())
+		Expect(c.Init()).To(BeNil())
+		defer c.Destroy()
+		data := fill(c)
+
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		write(&wg, c, data, 0, stop)
+
+		dest := collysqlite.NewCache("test-db-" + randomName())
+		defer os.Remove(dest.Path)
+		err := c.Backup(dest.Path, nil)
+		close(stop)
+		wg.Wait()
+		Expect(err).To(Equal(collysqlite.ErrBackupBusy))
+	})
+
+	It("should Backup a Storage", func() {
+		s := collysqlite.NewStorage("test-db-" + randomName())
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		u, _ := url.Parse("http://example.org")
+		Expect(s.Visited(1)).To(BeNil())
+		s.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+		})
+		Expect(s.AddRequest([]byte("a"))).To(BeNil())
+
+		name := "test-db-" + randomName()
+		Expect(s.Backup(name, nil)).To(BeNil())
+		b := collysqlite.NewStorage(name)
+		Expect(b.Init()).To(BeNil())
+		defer b.Destroy()
+		Expect(b.IsVisited(1)).To(BeTrue())
+		Expect(toStrings(b.Cookies(u))).To(Equal([]string{"session=1"}))
+		Expect(b.QueueSize()).To(Equal(1))
+	})
+})
@@ -1,7 +1,9 @@
 package collysqlite
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -19,13 +21,90 @@ const (
 		);
 		CREATE INDEX IF NOT EXISTS idx_cache_created_at ON cache(created_at);
 	`
+	addCacheRunDDL = `
+		ALTER TABLE cache ADD COLUMN run_id INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS idx_cache_run_id ON cache(run_id);
+	`
+	// Each URL redirects to one target, the latest seen;
+	// origin_url and hop place it in the chain of the original request.
+	addCacheRedirectDDL = `
+		CREATE TABLE IF NOT EXISTS redirect (
+			url				TEXT NOT NULL,
+			origin_url		TEXT NOT NULL,
+			hop				INTEGER NOT NULL,
+			status_code		INTEGER NOT NULL,
+			location		TEXT NOT NULL,
+			target_url		TEXT NOT NULL,
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (url)
+		);
+		CREATE INDEX IF NOT EXISTS idx_redirect_origin_url ON redirect(origin_url, hop);
+	`
+	// Rebuilds the table, as SQLite cannot alter a primary key,
+	// so that each run may cache a URL.
+	rekeyCacheRunDDL = `
+		CREATE TABLE cache_rekeyed (
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			url				TEXT NOT NULL,
+			data			BLOB,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (run_id, url)
+		);
+		INSERT INTO cache_rekeyed (run_id, url, data, created_at)
+			SELECT run_id, url, data, created_at FROM cache;
+		DROP TABLE cache;
+		ALTER TABLE cache_rekeyed RENAME TO cache;
+		CREATE INDEX IF NOT EXISTS idx_cache_created_at ON cache(created_at);
+	`
+	// Rebuilds the table, as SQLite cannot alter a primary key,
+	// so that each run records its own redirects.
+	rekeyRedirectRunDDL = `
+		CREATE TABLE redirect_rekeyed (
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			url				TEXT NOT NULL,
+			origin_url		TEXT NOT NULL,
+			hop				INTEGER NOT NULL,
+			status_code		INTEGER NOT NULL,
+			location		TEXT NOT NULL,
+			target_url		TEXT NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (run_id, url)
+		);
+		INSERT INTO redirect_rekeyed (run_id, url, origin_url, hop, status_code, location, target_url, created_at)
+			SELECT run_id, url, origin_url, hop, status_code, location, target_url, created_at FROM redirect;
+		DROP TABLE redirect;
+		ALTER TABLE redirect_rekeyed RENAME TO redirect;
+		CREATE INDEX IF NOT EXISTS idx_redirect_origin_url ON redirect(run_id, origin_url, hop);
+	`
+	// Indexes lookups of a URL across runs.
+	addCacheURLIndexDDL = `
+		CREATE INDEX IF NOT EXISTS idx_cache_url ON cache(url, created_at);
+		CREATE INDEX IF NOT EXISTS idx_redirect_url ON redirect(url, created_at);
+	`
 	dropCacheDDL = `
+		DROP INDEX IF EXISTS idx_redirect_url;
+		DROP INDEX IF EXISTS idx_redirect_origin_url;
+		DROP TABLE IF EXISTS redirect;
+		DROP INDEX IF EXISTS idx_cache_url;
+		DROP INDEX IF EXISTS idx_cache_run_id;
 		DROP INDEX IF EXISTS idx_cache_created_at;
 		DROP TABLE IF EXISTS cache;
 	`
 )
 
+// cacheMigrations are the steps that create and upgrade the cache schema.
+var cacheMigrations = []migration{
+	execMigration(createCacheDDL),
+	execMigration(addCacheRunDDL),
+	execMigration(addCacheRedirectDDL),
+	execMigration(rekeyCacheRunDDL),
+	execMigration(rekeyRedirectRunDDL),
+	execMigration(addCacheURLIndexDDL),
+}
+
 type cacheRecord struct {
+	RunID     int64     `db:"run_id"`
 	URL       string    `db:"url"`
 	Data      []byte    `db:"data"`
 	CreatedAt time.Time `db:"created_at"`
@@ -44,6 +123,14 @@ var _ cache = &Cache{}
 
 type Cache struct {
 	Path string
+	// Keys, if set, is used to encrypt cached data at rest.
+	Keys KeyProvider
+	// RunID, if set, is the Run that cache writes are tagged with, see Runs.
+	RunID int64
+	// ScopeReadsToRun, if set, restricts reads and removals to the data
+	// cached in RunID's run. Otherwise data cached in any run is read,
+	// the latest first, so that a run can reuse an earlier run's cache.
+	ScopeReadsToRun bool
 }
 
 func NewCache(path string) *Cache {
@@ -53,71 +140,239 @@ func NewCache(path string) *Cache {
 }
 
 func (c *Cache) Init() error {
+	return c.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (c *Cache) InitContext(ctx context.Context) error {
 	err := ensurePathExists(c.Path)
 	if err != nil {
 		return err
 	}
-	db, err := c.connect()
+	db, err := c.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(createCacheDDL)
-	return err
+	return migrate(ctx, db, "cache", cacheMigrations)
 }
 
 func (c *Cache) Destroy() error {
-	db, err := c.connect()
+	return c.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (c *Cache) DestroyContext(ctx context.Context) error {
+	db, err := c.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(dropCacheDDL)
+	_, err = db.ExecContext(ctx, dropCacheDDL)
 	if err != nil {
 		return err
 	}
-	return removeIfNoTables(db, c.Path)
+	err = forgetSchema(ctx, db, "cache")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, c.Path)
 }
 
+// Get returns the data cached for url, or nil if there is none.
+// If no data is cached for url itself, but it is in a recorded redirect
+// chain, see PutRedirects, the data cached for the final URL of the
+// chain is returned, unless the recorded redirects loop.
+// If url is cached in more than one run, the latest is returned,
+// unless ScopeReadsToRun is set.
 func (c *Cache) Get(url string) ([]byte, error) {
-	db, err := c.connect()
+	return c.GetContext(context.Background(), url)
+}
+
+// GetContext is like Get but includes a context.
+func (c *Cache) GetContext(ctx context.Context, url string) ([]byte, error) {
+	db, err := c.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer db.Close()
+	b, err := c.get(ctx, db, url)
+	if b != nil || err != nil {
+		return b, err
+	}
+	final, err := c.resolveRedirects(ctx, db, url)
+	if err == ErrRedirectLoop || final == url {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.get(ctx, db, final)
+}
+
+// get returns the data cached for url itself, or nil if there is none.
+func (c *Cache) get(ctx context.Context, db *sqlx.DB, url string) ([]byte, error) {
 	var b []byte
-	err = db.Get(&b, "SELECT data FROM cache WHERE url = ?", url)
+	err := db.GetContext(ctx, &b, `
+		SELECT data FROM cache WHERE (? OR run_id = ?) AND url = ?
+		ORDER BY created_at DESC LIMIT 1`, !c.ScopeReadsToRun, c.RunID, url)
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
-	return b, err
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(c.Keys, b, []byte(url))
 }
 
 func (c *Cache) Put(url string, data []byte) error {
-	db, err := c.connect()
+	return c.PutContext(context.Background(), url, data)
+}
+
+// PutContext is like Put but includes a context.
+func (c *Cache) PutContext(ctx context.Context, url string, data []byte) error {
+	if c.Keys != nil {
+		var err error
+		data, err = encrypt(c.Keys, data, []byte(url))
+		if err != nil {
+			return err
+		}
+	}
+	db, err := c.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 	r := &cacheRecord{
+		RunID:     c.RunID,
 		URL:       url,
 		Data:      data,
 		CreatedAt: time.Now(),
 	}
-	_, err = db.NamedExec("INSERT INTO cache (url, data, created_at) VALUES (:url, :data, :created_at)", r)
+	_, err = db.NamedExecContext(ctx, "INSERT INTO cache (run_id, url, data, created_at) VALUES (:run_id, :url, :data, :created_at)", r)
 	return err
 }
 
+// Remove removes the data cached for url, and any redirect recorded
+// from it, in every run unless ScopeReadsToRun is set.
 func (c *Cache) Remove(url string) error {
-	db, err := c.connect()
+	return c.RemoveContext(context.Background(), url)
+}
+
+// RemoveContext is like Remove but includes a context.
+func (c *Cache) RemoveContext(ctx context.Context, url string) error {
+	db, err := c.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec("DELETE FROM cache WHERE url = ?", url)
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM cache WHERE (? OR run_id = ?) AND url = ?", !c.ScopeReadsToRun, c.RunID, url)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM redirect WHERE (? OR run_id = ?) AND url = ?", !c.ScopeReadsToRun, c.RunID, url)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RotateKeys re-encrypts all cached data with the current key of Keys.
+// Keys must still be able to provide the keys it was encrypted with.
+// Data that is not yet encrypted is encrypted.
+//
+// Rows are re-encrypted in batches, each in its own transaction, so that
+// other writers are not held up for long. If RotateKeys fails part way,
+// it may be called again.
+func (c *Cache) RotateKeys() error {
+	return c.RotateKeysContext(context.Background())
+}
+
+// RotateKeysContext is like RotateKeys but includes a context.
+func (c *Cache) RotateKeysContext(ctx context.Context) error {
+	if c.Keys == nil {
+		return fmt.Errorf("collysqlite: no KeyProvider is set")
+	}
+	db, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var last *cacheRecord
+	for {
+		last, err = c.rotateKeys(ctx, db, last)
+		if err != nil || last == nil {
+			return err
+		}
+	}
+}
+
+// rotateKeys re-encrypts the batch of rows that follows last, or the first
+// batch if last is nil, and returns the last row of the batch, or nil
+// if there were no more rows.
+func (c *Cache) rotateKeys(ctx context.Context, db *sqlx.DB, last *cacheRecord) (*cacheRecord, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var rs []cacheRecord
+	if last == nil {
+		err = tx.SelectContext(ctx, &rs, "SELECT run_id, url, data, created_at FROM cache ORDER BY run_id, url LIMIT ?", rotateKeysBatchSize)
+	} else {
+		err = tx.SelectContext(ctx, &rs, "SELECT run_id, url, data, created_at FROM cache WHERE run_id > ? OR (run_id = ? AND url > ?) ORDER BY run_id, url LIMIT ?", last.RunID, last.RunID, last.URL, rotateKeysBatchSize)
+	}
+	if err != nil || len(rs) == 0 {
+		return nil, err
+	}
+	for _, r := range rs {
+		b, err := decrypt(c.Keys, r.Data, []byte(r.URL))
+		if err != nil {
+			return nil, err
+		}
+		b, err = encrypt(c.Keys, b, []byte(r.URL))
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE cache SET data = ? WHERE run_id = ? AND url = ?", b, r.RunID, r.URL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &rs[len(rs)-1], tx.Commit()
+}
+
+func (c *Cache) deleteRun(ctx context.Context, runID int64) error {
+	db, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM cache WHERE run_id = ?", runID)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM redirect WHERE run_id = ?", runID)
 	return err
 }
 
-func (c *Cache) connect() (*sqlx.DB, error) {
-	return sqlx.Connect("sqlite3", c.Path)
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the cache is in use.
+func (c *Cache) Backup(destPath string, progress func(BackupProgress)) error {
+	return c.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (c *Cache) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, c.Path, destPath, progress)
+}
+
+func (c *Cache) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", c.Path)
 }
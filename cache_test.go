@@ -1,6 +1,7 @@
 package collysqlite_test
 
 import (
+	"context"
 	"encoding/hex"
 	"log"
 	"math/rand"
@@ -68,6 +69,26 @@ var _ = Describe("Cache", func() {
 		// Remove non-existing.
 		Expect(c.Remove(url)).To(BeNil())
 	})
+
+	It("should honour a cancelled context", func() {
+		name := "test-db-" + randomName()
+		c := collysqlite.NewCache(name)
+		Expect(c.InitContext(context.Background())).To(BeNil())
+		defer c.Destroy()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		url := "http://example.org"
+		Expect(c.PutContext(ctx, url, []byte{1})).To(BeNil())
+		got, err := c.GetContext(ctx, url)
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal([]byte{1}))
+		cancel()
+		_, err = c.GetContext(ctx, url)
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(c.PutContext(ctx, "http://example.com", []byte{2})).To(MatchError(context.Canceled))
+		Expect(c.RemoveContext(ctx, url)).To(MatchError(context.Canceled))
+	})
+
 })
 
 func randomName() string {
@@ -0,0 +1,212 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultCheckpointTimeout is the CheckpointTimeout used when none is set.
+// It is less than the 5 seconds that writers wait for a lock.
+const DefaultCheckpointTimeout = 4 * time.Second
+
+// ErrCheckpointTimeout is returned by Checkpoint when the databases
+// could not be copied within CheckpointTimeout.
+var ErrCheckpointTimeout = errors.New("collysqlite: checkpoint timed out")
+
+// Checkpoint saves a consistent, point-in-time copy of every component
+// database, under the given name, replacing any existing checkpoint of
+// that name only once the copy is complete.
+//
+// While a checkpoint is taken, writes wait for it to finish, for up to
+// 5 seconds, after which they fail. So that they need not, Checkpoint
+// gives up after CheckpointTimeout, returning ErrCheckpointTimeout.
+// Large databases may need a longer timeout, at the risk of failed writes,
+// or a quiet moment.
+//
+// Checkpoints are held in the directory Path + "-checkpoints".
+func (s *Storage) Checkpoint(name string) error {
+	return s.CheckpointContext(context.Background(), name)
+}
+
+// CheckpointContext is like Checkpoint but includes a context.
+func (s *Storage) CheckpointContext(ctx context.Context, name string) error {
+	dir, err := s.checkpointDir(name)
+	if err != nil {
+		return err
+	}
+	err = s.ExplodingCookieJar.Jar.FlushContext(ctx)
+	if err != nil {
+		return err
+	}
+	// Copy to a temporary directory, so that a failed checkpoint
+	// does not replace a good one.
+	tmp := dir + ".partial"
+	err = os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(tmp, 0755)
+	if err != nil {
+		return err
+	}
+	timeout := s.CheckpointTimeout
+	if timeout <= 0 {
+		timeout = DefaultCheckpointTimeout
+	}
+	hctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = s.checkpoint(hctx, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		if ctx.Err() == nil && hctx.Err() == context.DeadlineExceeded {
+			return ErrCheckpointTimeout
+		}
+		return err
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dir)
+}
+
+// checkpoint copies every component database to dir.
+func (s *Storage) checkpoint(ctx context.Context, dir string) error {
+	// Hold a read transaction on every database until all have been
+	// copied, so that the copies are all of the same point in time.
+	paths := s.databasePaths()
+	conns := make([]*sql.Conn, len(paths))
+	for i, path := range paths {
+		c, closeConn, err := openConn(ctx, path)
+		if err != nil {
+			return err
+		}
+		defer closeConn()
+		_, err = c.ExecContext(ctx, "BEGIN")
+		if err != nil {
+			return err
+		}
+		defer c.ExecContext(context.Background(), "ROLLBACK")
+		var count int
+		err = c.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&count)
+		if err != nil {
+			return err
+		}
+		conns[i] = c
+	}
+	for i, path := range paths {
+		dst, closeConn, err := openConn(ctx, filepath.Join(dir, filepath.Base(path)))
+		if err != nil {
+			return err
+		}
+		err = copyDatabase(ctx, dst, conns[i], nil)
+		closeConn()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Restore replaces the contents of every component database with those
+// saved by Checkpoint under the given name. Components whose database
+// did not exist when the checkpoint was taken have their database
+// removed, and are initialised afresh.
+// It should not be called while the storage is in use.
+func (s *Storage) Restore(name string) error {
+	return s.RestoreContext(context.Background(), name)
+}
+
+// RestoreContext is like Restore but includes a context.
+func (s *Storage) RestoreContext(ctx context.Context, name string) error {
+	dir, err := s.checkpointDir(name)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("collysqlite: no checkpoint %q: %w", name, err)
+	}
+	removed := make(map[string]bool)
+	seen := make(map[string]bool)
+	for _, c := range s.components() {
+		path := databasePath(c)
+		if path == "" || seen[path] {
+			continue
+		}
+		seen[path] = true
+		src := filepath.Join(dir, filepath.Base(path))
+		_, err = os.Stat(src)
+		if os.IsNotExist(err) {
+			if databaseExists(c) {
+				err = removeDatabase(path)
+				if err != nil {
+					return err
+				}
+				removed[path] = true
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = copyDatabaseFile(ctx, path, src, nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, c := range s.components() {
+		if removed[databasePath(c)] {
+			err = initIfIniter(ctx, c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Discard cookies cached from before the restore.
+	for _, j := range s.ExplodingCookieJar.Jar.jars() {
+		j.reset()
+	}
+	return nil
+}
+
+// removeDatabase removes the database at path, and its journal files.
+func removeDatabase(path string) error {
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		err := os.Remove(path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpointDir returns the directory of the named checkpoint.
+func (s *Storage) checkpointDir(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.HasSuffix(name, ".partial") {
+		return "", fmt.Errorf("collysqlite: invalid checkpoint name %q", name)
+	}
+	return filepath.Join(s.Path+"-checkpoints", name), nil
+}
+
+// databasePaths returns the paths of the existing component databases,
+// each only once, as components may share a database.
+func (s *Storage) databasePaths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, c := range s.components() {
+		path := databasePath(c)
+		if path == "" || seen[path] || !databaseExists(c) {
+			continue
+		}
+		seen[path] = true
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,97 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Checkpoint", func() {
+
+	It("should Checkpoint and Restore", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		defer os.RemoveAll(name + "-checkpoints")
+
+		u, _ := url.Parse("http://example.org")
+		Expect(s.Visited(1)).To(BeNil())
+		Expect(s.Put("http://example.org/1", []byte{1})).To(BeNil())
+		s.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "good"},
+		})
+		Expect(s.AddRequest([]byte("a"))).To(BeNil())
+		Expect(s.Checkpoint("good")).To(BeNil())
+
+		// Things go wrong.
+		Expect(s.Visited(2)).To(BeNil())
+		Expect(s.Remove("http://example.org/1")).To(BeNil())
+		s.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "banned"},
+		})
+		_, err := s.GetRequest()
+		Expect(err).To(BeNil())
+
+		Expect(s.Restore("good")).To(BeNil())
+		Expect(s.IsVisited(1)).To(BeTrue())
+		Expect(s.IsVisited(2)).To(BeFalse())
+		Expect(s.Get("http://example.org/1")).To(Equal([]byte{1}))
+		Expect(toStrings(s.Cookies(u))).To(Equal([]string{"session=good"}))
+		Expect(s.QueueSize()).To(Equal(1))
+	})
+
+	It("should remove databases created since the checkpoint", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		defer os.RemoveAll(name + "-checkpoints")
+
+		Expect(s.Runs.Destroy()).To(BeNil())
+		Expect(s.Runs.Path).NotTo(BeAnExistingFile())
+		Expect(s.Checkpoint("before-runs")).To(BeNil())
+		Expect(s.Runs.Init()).To(BeNil())
+		_, err := s.StartRun("first", nil)
+		Expect(err).To(BeNil())
+
+		Expect(s.Restore("before-runs")).To(BeNil())
+		Expect(s.ListRuns()).To(BeEmpty())
+	})
+
+	It("should give up after CheckpointTimeout, keeping the previous checkpoint", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		defer os.RemoveAll(name + "-checkpoints")
+
+		Expect(s.Visited(1)).To(BeNil())
+		Expect(s.Checkpoint("good")).To(BeNil())
+		Expect(s.Visited(2)).To(BeNil())
+		s.CheckpointTimeout = time.Nanosecond
+		Expect(s.Checkpoint("good")).To(Equal(collysqlite.ErrCheckpointTimeout))
+		Expect(name + "-checkpoints/good.partial").NotTo(BeAnExistingFile())
+
+		Expect(s.Restore("good")).To(BeNil())
+		Expect(s.IsVisited(1)).To(BeTrue())
+		Expect(s.IsVisited(2)).To(BeFalse())
+	})
+
+	It("should reject unknown and invalid checkpoints", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+
+		Expect(s.Restore("missing")).To(MatchError(os.ErrNotExist))
+		Expect(s.Checkpoint("../escape")).NotTo(BeNil())
+		Expect(s.Checkpoint("")).NotTo(BeNil())
+	})
+})
@@ -1,13 +1,97 @@
 package collysqlite
 
 import (
+	"context"
 	"os"
 	"strings"
 
 	"github.com/jmoiron/sqlx"
 )
 
-//
+// Initer is implemented by components that need initialising before use.
+type Initer interface {
+	Init() error
+}
+
+// Destroyer is implemented by components that can destroy their persistent state.
+type Destroyer interface {
+	Destroy() error
+}
+
+// Closer is implemented by components that hold resources needing release.
+type Closer interface {
+	Close() error
+}
+
+// ContextIniter is an Initer whose initialisation can be given a context.
+type ContextIniter interface {
+	Initer
+	InitContext(ctx context.Context) error
+}
+
+// ContextDestroyer is a Destroyer whose destruction can be given a context.
+type ContextDestroyer interface {
+	Destroyer
+	DestroyContext(ctx context.Context) error
+}
+
+// ContextCloser is a Closer whose closing can be given a context.
+type ContextCloser interface {
+	Closer
+	CloseContext(ctx context.Context) error
+}
+
+// The following helpers call the context-aware method of c if it has one,
+// otherwise they check ctx then call the plain method, if c has it.
+
+// initIfIniter calls Init on c if it is an Initer.
+func initIfIniter(ctx context.Context, c interface{}) error {
+	if i, ok := c.(ContextIniter); ok {
+		return i.InitContext(ctx)
+	}
+	if i, ok := c.(Initer); ok {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return i.Init()
+	}
+	return nil
+}
+
+// destroyIfDestroyer calls Destroy on c if it is a Destroyer.
+func destroyIfDestroyer(ctx context.Context, c interface{}) error {
+	if d, ok := c.(ContextDestroyer); ok {
+		return d.DestroyContext(ctx)
+	}
+	if d, ok := c.(Destroyer); ok {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return d.Destroy()
+	}
+	return nil
+}
+
+// closeIfCloser calls Close on c if it is a Closer.
+func closeIfCloser(ctx context.Context, c interface{}) error {
+	if cl, ok := c.(ContextCloser); ok {
+		return cl.CloseContext(ctx)
+	}
+	if cl, ok := c.(Closer); ok {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		return cl.Close()
+	}
+	return nil
+}
+
+// busyTimeout is how long, in milliseconds, a connection waits for another
+// to release its lock on the database, for stores with concurrent consumers.
+const busyTimeout = "5000"
 
 func ensurePathExists(path string) error {
 	i := strings.LastIndexByte(path, '/')
@@ -21,9 +105,11 @@ func ensurePathExists(path string) error {
 	return nil
 }
 
-func removeIfNoTables(db *sqlx.DB, path string) error {
+// removeIfNoTables removes the database at path if it has no tables,
+// ignoring SQLite's internal tables, such as sqlite_sequence.
+func removeIfNoTables(ctx context.Context, db *sqlx.DB, path string) error {
 	count := 0
-	err := db.Get(&count, "SELECT COUNT(*) FROM sqlite_master WHERE type='table'")
+	err := db.GetContext(ctx, &count, "SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name NOT LIKE 'sqlite_%'")
 	if err != nil {
 		return err
 	}
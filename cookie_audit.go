@@ -0,0 +1,214 @@
+package collysqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// CookieChangeKind is the kind of a CookieChange.
+type CookieChangeKind string
+
+const (
+	// CookieSet is a new cookie being set.
+	CookieSet CookieChangeKind = "set"
+	// CookieUpdate is an existing cookie being replaced with a different one.
+	CookieUpdate CookieChangeKind = "update"
+	// CookieExpire is an existing cookie being dropped because it has expired.
+	CookieExpire CookieChangeKind = "expire"
+	// CookieDelete is an existing cookie being removed before it has expired,
+	// either by the server or by eviction due to CookieLimits.
+	CookieDelete CookieChangeKind = "delete"
+)
+
+// CookieChange is a change made to a cookie held in a CookieStoreJar.
+// Cookie values are not recorded, only their hashes.
+type CookieChange struct {
+	Kind   CookieChangeKind `db:"kind"`
+	Host   string           `db:"host"`
+	Name   string           `db:"name"`
+	Domain string           `db:"domain"`
+	Path   string           `db:"path"`
+	// OldHash is the hash of the value before the change, or empty if none.
+	OldHash string `db:"old_hash"`
+	// NewHash is the hash of the value after the change, or empty if none.
+	NewHash string `db:"new_hash"`
+	// URL is the URL whose response caused the change.
+	URL  string    `db:"url"`
+	Time time.Time `db:"created_at"`
+}
+
+// CookieAuditor records changes made to cookies.
+type CookieAuditor interface {
+	RecordCookieChanges(changes []CookieChange) error
+}
+
+var _ CookieAuditor = &SQLiteCookieStore{}
+
+// recordCookieChanges calls RecordCookieChangesContext if a has it,
+// otherwise it checks ctx then calls RecordCookieChanges.
+func recordCookieChanges(ctx context.Context, a CookieAuditor, changes []CookieChange) error {
+	if ca, ok := a.(interface {
+		RecordCookieChangesContext(ctx context.Context, changes []CookieChange) error
+	}); ok {
+		return ca.RecordCookieChangesContext(ctx, changes)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return a.RecordCookieChanges(changes)
+}
+
+// EnableAudit records all changes to the cookies of the jar,
+// and of its profiles, in its database, see CookieHistory.
+func (j *CookieJar) EnableAudit() {
+	j.Auditor = j.SQLiteCookieStore
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, p := range j.profiles {
+		p.Auditor = p.SQLiteCookieStore
+	}
+}
+
+// auditsInTx reports whether the Auditor is the Store itself,
+// so that changes can be recorded in the transaction that makes them.
+func (j *CookieStoreJar) auditsInTx() bool {
+	a, ok := j.Store.(CookieAuditor)
+	return ok && j.Auditor != nil && a == j.Auditor
+}
+
+// audit records changes with the Auditor, outside of any transaction.
+// Errors are ignored, so that they do not fail the write that was made.
+func (j *CookieStoreJar) audit(ctx context.Context, changes []CookieChange) {
+	if j.Auditor == nil || len(changes) == 0 {
+		return
+	}
+	recordCookieChanges(ctx, j.Auditor, changes)
+}
+
+// diffCookies returns the changes that turn a host's cookies from before to after.
+func diffCookies(host, source string, before, after []storedCookie, now time.Time) []CookieChange {
+	old := make(map[cookieKey]storedCookie, len(before))
+	for _, c := range before {
+		old[keyOf(host, c)] = c
+	}
+	kept := make(map[cookieKey]bool, len(after))
+	var changes []CookieChange
+	for _, c := range after {
+		k := keyOf(host, c)
+		kept[k] = true
+		o, ok := old[k]
+		switch {
+		case !ok || isExpired(o.Cookie, now):
+			changes = append(changes, newCookieChange(CookieSet, host, source, k, nil, c.Cookie, now))
+		case auditString(o) != auditString(c):
+			changes = append(changes, newCookieChange(CookieUpdate, host, source, k, o.Cookie, c.Cookie, now))
+		}
+	}
+	for _, o := range before {
+		k := keyOf(host, o)
+		if kept[k] {
+			continue
+		}
+		kind := CookieDelete
+		if isExpired(o.Cookie, now) {
+			kind = CookieExpire
+		}
+		changes = append(changes, newCookieChange(kind, host, source, k, o.Cookie, nil, now))
+	}
+	return changes
+}
+
+func newCookieChange(kind CookieChangeKind, host, source string, k cookieKey, before, after *http.Cookie, now time.Time) CookieChange {
+	c := CookieChange{
+		Kind:   kind,
+		Host:   host,
+		Name:   k.name,
+		Domain: k.domain,
+		Path:   k.path,
+		URL:    source,
+		Time:   now,
+	}
+	if before != nil {
+		c.OldHash = hashValue(before.Value)
+	}
+	if after != nil {
+		c.NewHash = hashValue(after.Value)
+	}
+	return c
+}
+
+// auditString returns the serialisation of c that is compared to
+// detect updates, which ignores the cookie's access time. Cookies
+// whose expiry cannot be serialised, which are clamped when set, are
+// compared by their Set-Cookie line.
+func auditString(c storedCookie) string {
+	c.LastAccess = time.Time{}
+	s, err := stringify([]storedCookie{c})
+	if err != nil {
+		return c.String()
+	}
+	return s
+}
+
+func hashValue(v string) string {
+	h := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(h[:])
+}
+
+// RecordCookieChanges stores changes in the audit table.
+func (s *SQLiteCookieStore) RecordCookieChanges(changes []CookieChange) error {
+	return s.RecordCookieChangesContext(context.Background(), changes)
+}
+
+// RecordCookieChangesContext is like RecordCookieChanges but includes a context.
+func (s *SQLiteCookieStore) RecordCookieChangesContext(ctx context.Context, changes []CookieChange) error {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = s.recordCookieChanges(ctx, tx, changes)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteCookieStore) recordCookieChanges(ctx context.Context, e sqlx.ExecerContext, changes []CookieChange) error {
+	for _, c := range changes {
+		_, err := e.ExecContext(ctx, "INSERT INTO cookie_jar_audit (profile, host, kind, name, domain, path, old_hash, new_hash, url, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			s.ProfileName, c.Host, c.Kind, c.Name, c.Domain, c.Path, c.OldHash, c.NewHash, c.URL, c.Time)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CookieHistory returns the recorded changes to the cookies of host, oldest first.
+func (s *SQLiteCookieStore) CookieHistory(host string) ([]CookieChange, error) {
+	return s.CookieHistoryContext(context.Background(), host)
+}
+
+// CookieHistoryContext is like CookieHistory but includes a context.
+func (s *SQLiteCookieStore) CookieHistoryContext(ctx context.Context, host string) ([]CookieChange, error) {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var changes []CookieChange
+	err = db.SelectContext(ctx, &changes, "SELECT kind, host, name, domain, path, old_hash, new_hash, url, created_at FROM cookie_jar_audit WHERE profile = ? AND host = ? ORDER BY id", s.ProfileName, host)
+	return changes, err
+}
@@ -0,0 +1,222 @@
+package collysqlite_test
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+	"github.com/jmoiron/sqlx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieJar audit", func() {
+
+	var j *collysqlite.CookieJar
+	var changes []collysqlite.CookieChange
+	u, _ := url.Parse("http://example.org/login")
+
+	BeforeEach(func() {
+		j = collysqlite.NewCookieJar("test-db-" + randomName())
+		Expect(j.Init()).To(BeNil())
+		changes = nil
+		j.OnChange = func(c collysqlite.CookieChange) {
+			changes = append(changes, c)
+		}
+		j.EnableAudit()
+	})
+
+	AfterEach(func() {
+		Expect(j.Destroy()).To(BeNil())
+	})
+
+	kinds := func(cs []collysqlite.CookieChange) []collysqlite.CookieChangeKind {
+		k := make([]collysqlite.CookieChangeKind, len(cs))
+		for i, c := range cs {
+			k[i] = c.Kind
+		}
+		return k
+	}
+
+	It("should report set, update and delete", func() {
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1", Path: "/"},
+		})).To(BeNil())
+		// Setting an identical cookie is not a change.
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1", Path: "/"},
+		})).To(BeNil())
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "2", Path: "/"},
+		})).To(BeNil())
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Path: "/", MaxAge: -1},
+		})).To(BeNil())
+
+		Expect(kinds(changes)).To(Equal([]collysqlite.CookieChangeKind{
+			collysqlite.CookieSet,
+			collysqlite.CookieUpdate,
+			collysqlite.CookieDelete,
+		}))
+		Expect(changes[0].Host).To(Equal("example.org"))
+		Expect(changes[0].Name).To(Equal("session"))
+		Expect(changes[0].Path).To(Equal("/"))
+		Expect(changes[0].URL).To(Equal("http://example.org/login"))
+		Expect(changes[0].OldHash).To(Equal(""))
+		Expect(changes[0].NewHash).NotTo(Equal(""))
+		Expect(changes[1].OldHash).To(Equal(changes[0].NewHash))
+		Expect(changes[1].NewHash).NotTo(Equal(changes[0].NewHash))
+		Expect(changes[2].OldHash).To(Equal(changes[1].NewHash))
+		Expect(changes[2].NewHash).To(Equal(""))
+	})
+
+	It("should report expiry", func() {
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "short", Value: "1", Expires: time.Now().Add(time.Second)},
+		})).To(BeNil())
+		time.Sleep(1100 * time.Millisecond)
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "other", Value: "1"},
+		})).To(BeNil())
+		Expect(kinds(changes)).To(Equal([]collysqlite.CookieChangeKind{
+			collysqlite.CookieSet,
+			collysqlite.CookieSet,
+			collysqlite.CookieExpire,
+		}))
+		Expect(changes[2].Name).To(Equal("short"))
+	})
+
+	It("should report evictions as deletes", func() {
+		j.Limits.MaxCookiesPerDomain = 1
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "a", Value: "1"},
+		})).To(BeNil())
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "b", Value: "1"},
+		})).To(BeNil())
+		Expect(kinds(changes)).To(Equal([]collysqlite.CookieChangeKind{
+			collysqlite.CookieSet,
+			collysqlite.CookieSet,
+			collysqlite.CookieDelete,
+		}))
+		Expect(changes[2].Name).To(Equal("a"))
+	})
+
+	It("should record history per host", func() {
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+		})).To(BeNil())
+		other, _ := url.Parse("http://example.com")
+		Expect(j.SetCookies(other, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+		})).To(BeNil())
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "2"},
+		})).To(BeNil())
+
+		history, err := j.CookieHistory("example.org")
+		Expect(err).To(BeNil())
+		Expect(kinds(history)).To(Equal([]collysqlite.CookieChangeKind{
+			collysqlite.CookieSet,
+			collysqlite.CookieUpdate,
+		}))
+		Expect(history[1].OldHash).To(Equal(changes[0].NewHash))
+		Expect(history[1].NewHash).To(Equal(changes[2].NewHash))
+		Expect(history[1].URL).To(Equal("http://example.org/login"))
+		Expect(history[1].Time).To(BeTemporally("~", changes[2].Time, time.Second))
+	})
+
+	It("should not store cookies whose changes cannot be recorded", func() {
+		db, err := sqlx.Connect("sqlite3", j.SQLiteCookieStore.Path)
+		Expect(err).To(BeNil())
+		_, err = db.Exec("CREATE TRIGGER fail_audit BEFORE INSERT ON cookie_jar_audit BEGIN SELECT RAISE(ABORT, 'audit failed'); END")
+		Expect(err).To(BeNil())
+		Expect(db.Close()).To(BeNil())
+
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+		})).NotTo(BeNil())
+		Expect(j.Cookies(u)).To(BeEmpty())
+		Expect(changes).To(BeEmpty())
+	})
+
+	It("should ignore errors recording changes elsewhere", func() {
+		a := &failingAuditor{}
+		j.Auditor = a
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+		})).To(BeNil())
+		Expect(a.calls).To(Equal(1))
+		Expect(j.Cookies(u)).To(HaveLen(1))
+	})
+
+	It("should record changes held by write-behind when they are flushed", func() {
+		j.EnableCache(collysqlite.CookieCacheConfig{FlushInterval: time.Hour})
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+		})).To(BeNil())
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "2"},
+		})).To(BeNil())
+		Expect(changes).To(HaveLen(2))
+		history, err := j.CookieHistory("example.org")
+		Expect(err).To(BeNil())
+		Expect(history).To(BeEmpty())
+
+		Expect(j.Flush()).To(BeNil())
+		history, err = j.CookieHistory("example.org")
+		Expect(err).To(BeNil())
+		Expect(kinds(history)).To(Equal([]collysqlite.CookieChangeKind{
+			collysqlite.CookieSet,
+			collysqlite.CookieUpdate,
+		}))
+	})
+
+	It("should let OnChange and the Auditor use the jar", func() {
+		var seen []int
+		use := func() {
+			got, err := j.Cookies(u)
+			Expect(err).To(BeNil())
+			seen = append(seen, len(got))
+		}
+		j.OnChange = func(c collysqlite.CookieChange) { use() }
+		j.Auditor = auditorFunc(func(changes []collysqlite.CookieChange) error {
+			use()
+			return nil
+		})
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(done)
+			Expect(j.SetCookies(u, []*http.Cookie{
+				&http.Cookie{Name: "session", Value: "1"},
+			})).To(BeNil())
+			// With write-behind, changes are recorded when flushed.
+			j.EnableCache(collysqlite.CookieCacheConfig{FlushInterval: time.Hour})
+			Expect(j.SetCookies(u, []*http.Cookie{
+				&http.Cookie{Name: "session", Value: "2"},
+			})).To(BeNil())
+			Expect(j.Flush()).To(BeNil())
+		}()
+		Eventually(done, "5s").Should(BeClosed())
+		Expect(seen).To(Equal([]int{1, 1, 1, 1}))
+	})
+})
+
+type auditorFunc func(changes []collysqlite.CookieChange) error
+
+func (f auditorFunc) RecordCookieChanges(changes []collysqlite.CookieChange) error {
+	return f(changes)
+}
+
+type failingAuditor struct {
+	calls int
+}
+
+func (a *failingAuditor) RecordCookieChanges(changes []collysqlite.CookieChange) error {
+	a.calls++
+	return errors.New("audit failed")
+}
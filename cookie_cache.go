@@ -0,0 +1,371 @@
+package collysqlite
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// VersionedCookieStore is implemented by CookieStores that can report
+// when a host's cookies have been modified, such as by another process.
+// It allows a CookieStoreJar's cache to be invalidated when its contents
+// become stale.
+type VersionedCookieStore interface {
+	CookieStore
+	// Version returns a counter for the given host that increases by
+	// exactly one for each call to SetCookies for that host, and that
+	// changes whenever the host's cookies are modified by any other means.
+	Version(host string) (int64, error)
+}
+
+// DefaultCookieCacheMaxStaleness is the MaxStaleness used when none is set.
+const DefaultCookieCacheMaxStaleness = time.Second
+
+// CookieCacheConfig configures the in-memory cache of a CookieStoreJar.
+type CookieCacheConfig struct {
+	// MaxStaleness is how long a host's cached cookies may be served before
+	// checking the store for changes made elsewhere. Each check queries
+	// the store, so small values cost a query on almost every read.
+	// Zero uses DefaultCookieCacheMaxStaleness, and a negative value
+	// checks on every read.
+	// Checks are only possible if the store is a VersionedCookieStore.
+	MaxStaleness time.Duration
+	// FlushInterval, if non-zero, enables write-behind: writes are held in
+	// memory and flushed to the store in batches at this interval, and by
+	// Flush and Close. Zero writes through to the store synchronously.
+	// Write-behind is only safe for a single process: a flush overwrites
+	// any changes made to the same hosts by other processes.
+	FlushInterval time.Duration
+}
+
+// EnableCache enables an in-memory cache of parsed cookies, so that reads
+// are served without querying the store and reparsing its contents.
+// It should be called before the jar is used.
+func (j *CookieStoreJar) EnableCache(cfg CookieCacheConfig) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cache != nil {
+		j.cache.stopTimer()
+	}
+	if cfg.MaxStaleness == 0 {
+		cfg.MaxStaleness = DefaultCookieCacheMaxStaleness
+	}
+	j.cache = newCookieCache(cfg, func() { j.Flush() })
+}
+
+// Flush writes any cookies held by the cache's write-behind to the store.
+func (j *CookieStoreJar) Flush() error {
+	return j.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but includes a context.
+// Errors are not lost: unflushed cookies are retried on the next flush,
+// and errors are returned by Flush and Close.
+func (j *CookieStoreJar) FlushContext(ctx context.Context) error {
+	j.mu.Lock()
+	unaudited, err := j.flush(ctx)
+	j.mu.Unlock()
+	j.audit(ctx, unaudited)
+	return err
+}
+
+// flush writes any cookies held by the cache's write-behind to the store,
+// returning the changes written that the Auditor is yet to record.
+// The caller must hold j.mu for writing.
+func (j *CookieStoreJar) flush(ctx context.Context) ([]CookieChange, error) {
+	if j.cache == nil {
+		return nil, nil
+	}
+	var unaudited []CookieChange
+	err := j.cache.flush(func(host, cs string, changes []CookieChange) error {
+		u, err := j.writeFlushed(ctx, host, cs, changes)
+		if err != nil {
+			return err
+		}
+		unaudited = append(unaudited, u...)
+		return nil
+	})
+	return unaudited, err
+}
+
+// storeVersion calls VersionContext if s has it,
+// otherwise it checks ctx then calls Version.
+func storeVersion(ctx context.Context, s VersionedCookieStore, host string) (int64, error) {
+	if cs, ok := s.(interface {
+		VersionContext(ctx context.Context, host string) (int64, error)
+	}); ok {
+		return cs.VersionContext(ctx, host)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return s.Version(host)
+}
+
+type cookieCacheEntry struct {
+	cookies []storedCookie
+	cs      string
+	dirty   bool
+	// stored is the number of cookies held for the host by the store.
+	stored int
+	// pending are the changes made by unflushed writes.
+	pending []CookieChange
+	// version is the store's version of the host when last read or
+	// written, if versioned, and checked is when it was last compared.
+	version   int64
+	versioned bool
+	checked   time.Time
+}
+
+type cookieCache struct {
+	cfg     CookieCacheConfig
+	mu      sync.Mutex
+	entries map[string]*cookieCacheEntry
+	// timer, if not nil, calls onFlush once FlushInterval has passed since
+	// an unflushed write. It is only armed while there are such writes.
+	timer   *time.Timer
+	onFlush func()
+}
+
+func newCookieCache(cfg CookieCacheConfig, onFlush func()) *cookieCache {
+	return &cookieCache{
+		cfg:     cfg,
+		entries: make(map[string]*cookieCacheEntry),
+		onFlush: onFlush,
+	}
+}
+
+// stopTimer stops any pending periodic flush.
+func (c *cookieCache) stopTimer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+// reset discards all cached entries, including unflushed writes.
+func (c *cookieCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*cookieCacheEntry)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+}
+
+func (c *cookieCache) load(ctx context.Context, store CookieStore, host string) ([]storedCookie, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if ok {
+		stale, err := c.stale(ctx, store, host, e)
+		if err != nil {
+			return nil, err
+		}
+		ok = !stale
+	}
+	if !ok {
+		e = &cookieCacheEntry{}
+		vs, versioned := store.(VersionedCookieStore)
+		if versioned {
+			// Read the version first, so that a change made between the
+			// two reads is seen as a change by the next check.
+			v, err := storeVersion(ctx, vs, host)
+			if err != nil {
+				return nil, err
+			}
+			e.version = v
+			e.versioned = true
+			e.checked = time.Now()
+		}
+		cs, err := storeCookies(ctx, store, host)
+		if err != nil {
+			return nil, err
+		}
+		e.cs = cs
+		if cs != "" {
+			e.cookies, err = unstringify(cs, host)
+			if err != nil {
+				return nil, err
+			}
+		}
+		e.stored = len(e.cookies)
+		c.entries[host] = e
+	}
+	if e.cookies == nil {
+		return nil, nil
+	}
+	// Callers may modify the returned cookies, so give them copies.
+	return copyCookies(e.cookies), nil
+}
+
+// stale reports whether the host's cookies have been modified elsewhere
+// since entry e was read, checking at most once per MaxStaleness.
+// Unflushed writes are never stale, and will overwrite any changes
+// made elsewhere.
+func (c *cookieCache) stale(ctx context.Context, store CookieStore, host string, e *cookieCacheEntry) (bool, error) {
+	if e.dirty {
+		return false, nil
+	}
+	vs, ok := store.(VersionedCookieStore)
+	if !ok {
+		return false, nil
+	}
+	if !e.versioned {
+		return true, nil
+	}
+	now := time.Now()
+	if c.cfg.MaxStaleness > 0 && now.Sub(e.checked) < c.cfg.MaxStaleness {
+		return false, nil
+	}
+	v, err := storeVersion(ctx, vs, host)
+	if err != nil {
+		return false, err
+	}
+	e.checked = now
+	return v != e.version, nil
+}
+
+// newCookieCacheEntry returns an entry holding cs, the serialised cookies of host.
+func newCookieCacheEntry(host string, cs string) (*cookieCacheEntry, error) {
+	e := &cookieCacheEntry{cs: cs}
+	if cs != "" {
+		var err error
+		e.cookies, err = unstringify(cs, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e.stored = len(e.cookies)
+	return e, nil
+}
+
+// save caches cs, the serialised cookies of host, holding it until flushed
+// with the changes it makes if write-behind is enabled, otherwise writing
+// it to store.
+func (c *cookieCache) save(ctx context.Context, store CookieStore, host string, cs string, changes []CookieChange) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Cache the cookies as they will be read back from the store.
+	e, err := newCookieCacheEntry(host, cs)
+	if err != nil {
+		return err
+	}
+	if old, ok := c.entries[host]; ok {
+		e.version = old.version
+		e.versioned = old.versioned
+		e.checked = old.checked
+		e.stored = old.stored
+		if old.dirty {
+			e.pending = old.pending
+		}
+	} else {
+		e.stored = 0
+	}
+	if c.cfg.FlushInterval > 0 {
+		e.dirty = true
+		e.pending = append(e.pending, changes...)
+		c.entries[host] = e
+		c.arm()
+		return nil
+	}
+	err = storeSetCookies(ctx, store, host, cs)
+	if err != nil {
+		delete(c.entries, host)
+		return err
+	}
+	e.wrote()
+	c.entries[host] = e
+	return nil
+}
+
+// current returns a copy of host's cached cookies, if they are
+// held at version v of the store.
+func (c *cookieCache) current(host string, v int64) ([]storedCookie, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok || !e.versioned || e.version != v || e.dirty {
+		return nil, false
+	}
+	return copyCookies(e.cookies), true
+}
+
+// put caches e, written to the store elsewhere.
+func (c *cookieCache) put(host string, e *cookieCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[host] = e
+}
+
+// unflushedHosts returns the hosts with unflushed writes.
+func (c *cookieCache) unflushedHosts() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var hosts []string
+	for host, e := range c.entries {
+		if e.dirty {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// unflushedCount returns the change in the number of cookies held
+// that is yet to be flushed to the store.
+func (c *cookieCache) unflushedCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, e := range c.entries {
+		if e.dirty {
+			n += len(e.cookies) - e.stored
+		}
+	}
+	return n
+}
+
+// arm schedules a flush, if one is not already pending.
+// The caller must hold c.mu.
+func (c *cookieCache) arm() {
+	if c.timer == nil && c.onFlush != nil {
+		c.timer = time.AfterFunc(c.cfg.FlushInterval, c.onFlush)
+	}
+}
+
+// flush calls write with each host's unflushed cookies,
+// and the changes they make.
+func (c *cookieCache) flush(write func(host, cs string, changes []CookieChange) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	for host, e := range c.entries {
+		if !e.dirty {
+			continue
+		}
+		err := write(host, e.cs, e.pending)
+		if err != nil {
+			// Retry on the next flush.
+			c.arm()
+			return err
+		}
+		e.wrote()
+		e.dirty = false
+		e.pending = nil
+	}
+	return nil
+}
+
+// wrote records that the cache itself has written the entry to the store,
+// so that the write is not mistaken for a change made elsewhere.
+func (e *cookieCacheEntry) wrote() {
+	e.version++
+	e.stored = len(e.cookies)
+}
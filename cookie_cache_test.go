@@ -0,0 +1,169 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieJar cache", func() {
+
+	url, _ := url.Parse("http://example.org")
+
+	setValue := func(j *collysqlite.CookieJar, value string) {
+		Expect(j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: value},
+		})).To(BeNil())
+	}
+
+	getValue := func(j *collysqlite.CookieJar) string {
+		got, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		if len(got) == 0 {
+			return ""
+		}
+		Expect(got).To(HaveLen(1))
+		return got[0].Value
+	}
+
+	It("should write through and see changes made elsewhere", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{MaxStaleness: -1})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		// A second jar over the same file, standing in for another process.
+		other := collysqlite.NewCookieJar(name)
+
+		setValue(j, "1")
+		Expect(getValue(j)).To(Equal("1"))
+		Expect(getValue(other)).To(Equal("1"))
+
+		setValue(other, "2")
+		Expect(getValue(j)).To(Equal("2"))
+	})
+
+	It("should serve cached cookies until MaxStaleness", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{MaxStaleness: time.Hour})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		other := collysqlite.NewCookieJar(name)
+
+		setValue(j, "1")
+		Expect(getValue(j)).To(Equal("1"))
+		setValue(other, "2")
+		Expect(getValue(j)).To(Equal("1"))
+	})
+
+	It("should not lose cookies set elsewhere when writing", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{MaxStaleness: time.Hour})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		other := collysqlite.NewCookieJar(name)
+
+		set := func(j *collysqlite.CookieJar, name string) {
+			Expect(j.SetCookies(url, []*http.Cookie{
+				&http.Cookie{Name: name, Value: "1"},
+			})).To(BeNil())
+		}
+		set(j, "a")
+		set(other, "b")
+		// The cache is stale, but the write merges with the stored cookies.
+		set(j, "c")
+
+		got, err := collysqlite.NewCookieJar(name).Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(3))
+	})
+
+	It("should see changes made elsewhere after the default MaxStaleness", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		other := collysqlite.NewCookieJar(name)
+
+		setValue(j, "1")
+		Expect(getValue(j)).To(Equal("1"))
+		setValue(other, "2")
+		Expect(getValue(j)).To(Equal("1"))
+		Eventually(func() string { return getValue(j) }, 3*time.Second).Should(Equal("2"))
+	})
+
+	It("should version each host of each profile separately", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.Version("example.org")).To(BeZero())
+		setValue(j, "1")
+		setValue(j, "2")
+		Expect(j.Version("example.org")).To(Equal(int64(2)))
+		Expect(j.Version("example.com")).To(BeZero())
+		Expect(j.Profile("alice").Version("example.org")).To(BeZero())
+		setValue(j.Profile("alice"), "1")
+		Expect(j.Profile("alice").Version("example.org")).To(Equal(int64(1)))
+		Expect(j.Version("example.org")).To(Equal(int64(2)))
+	})
+
+	It("should not hand out cached cookies for modification", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		setValue(j, "1")
+		got, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		got[0].Value = "modified"
+		Expect(getValue(j)).To(Equal("1"))
+	})
+
+	It("should write behind", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{MaxStaleness: -1, FlushInterval: time.Hour})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		other := collysqlite.NewCookieJar(name)
+
+		setValue(j, "1")
+		Expect(getValue(j)).To(Equal("1"))
+		Expect(getValue(other)).To(Equal(""))
+		Expect(j.Flush()).To(BeNil())
+		Expect(getValue(other)).To(Equal("1"))
+
+		// Own flushed writes do not invalidate the cache,
+		// but changes made elsewhere do.
+		setValue(j, "2")
+		Expect(j.Close()).To(BeNil())
+		Expect(getValue(other)).To(Equal("2"))
+		setValue(other, "3")
+		Expect(getValue(j)).To(Equal("3"))
+	})
+
+	It("should flush periodically", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.EnableCache(collysqlite.CookieCacheConfig{FlushInterval: 10 * time.Millisecond})
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		defer j.Close()
+		other := collysqlite.NewCookieJar(name)
+
+		setValue(j, "1")
+		Eventually(func() string { return getValue(other) }).Should(Equal("1"))
+	})
+})
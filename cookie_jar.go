@@ -1,11 +1,12 @@
 package collysqlite
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"strings"
 	"sync"
 	"time"
 
@@ -13,6 +14,7 @@ import (
 )
 
 const (
+	// createCookieJarDDL is the original schema, before profiles.
 	createCookieJarDDL = `
 		CREATE TABLE IF NOT EXISTS cookie_jar (
 			host			TEXT NOT NULL UNIQUE,
@@ -24,13 +26,129 @@ const (
 		CREATE INDEX IF NOT EXISTS idx_cookie_jar_created_at ON cookie_jar(created_at);
 		CREATE INDEX IF NOT EXISTS idx_cookie_jar_modified_at ON cookie_jar(modified_at);
 	`
+	// addCookieJarProfileDDL rebuilds the table with a profile column,
+	// which becomes part of the primary key.
+	addCookieJarProfileDDL = `
+		CREATE TABLE cookie_jar_new (
+			profile			TEXT NOT NULL DEFAULT '',
+			host			TEXT NOT NULL,
+			cookies			TEXT NOT NULL,
+			modified_at		DATETIME,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (profile, host)
+		);
+		INSERT INTO cookie_jar_new (host, cookies, modified_at, created_at)
+			SELECT host, cookies, modified_at, created_at FROM cookie_jar;
+		DROP TABLE cookie_jar;
+		ALTER TABLE cookie_jar_new RENAME TO cookie_jar;
+		CREATE INDEX IF NOT EXISTS idx_cookie_jar_created_at ON cookie_jar(created_at);
+		CREATE INDEX IF NOT EXISTS idx_cookie_jar_modified_at ON cookie_jar(modified_at);
+	`
+	createCookieJarVersionDDL = `
+		CREATE TABLE IF NOT EXISTS cookie_jar_version (
+			id				INTEGER NOT NULL CHECK (id = 0),
+			version			INTEGER NOT NULL,
+			PRIMARY KEY (id)
+		);
+		INSERT OR IGNORE INTO cookie_jar_version (id, version) VALUES (0, 0);
+		CREATE TRIGGER IF NOT EXISTS trg_cookie_jar_insert AFTER INSERT ON cookie_jar
+			BEGIN UPDATE cookie_jar_version SET version = version + 1; END;
+		CREATE TRIGGER IF NOT EXISTS trg_cookie_jar_update AFTER UPDATE ON cookie_jar
+			BEGIN UPDATE cookie_jar_version SET version = version + 1; END;
+		CREATE TRIGGER IF NOT EXISTS trg_cookie_jar_delete AFTER DELETE ON cookie_jar
+			BEGIN UPDATE cookie_jar_version SET version = version + 1; END;
+	`
+	// addCookieJarHostVersionDDL replaces the single version of the
+	// whole table with a version per profile and host.
+	addCookieJarHostVersionDDL = `
+		DROP TRIGGER IF EXISTS trg_cookie_jar_insert;
+		DROP TRIGGER IF EXISTS trg_cookie_jar_update;
+		DROP TRIGGER IF EXISTS trg_cookie_jar_delete;
+		DROP TABLE IF EXISTS cookie_jar_version;
+		CREATE TABLE cookie_jar_version (
+			profile			TEXT NOT NULL,
+			host			TEXT NOT NULL,
+			version			INTEGER NOT NULL,
+			PRIMARY KEY (profile, host)
+		);
+		INSERT INTO cookie_jar_version (profile, host, version)
+			SELECT profile, host, 1 FROM cookie_jar;
+		CREATE TRIGGER trg_cookie_jar_insert AFTER INSERT ON cookie_jar
+			BEGIN
+				INSERT INTO cookie_jar_version (profile, host, version) VALUES (NEW.profile, NEW.host, 1)
+					ON CONFLICT (profile, host) DO UPDATE SET version = version + 1;
+			END;
+		CREATE TRIGGER trg_cookie_jar_update AFTER UPDATE ON cookie_jar
+			BEGIN
+				INSERT INTO cookie_jar_version (profile, host, version)
+					SELECT OLD.profile, OLD.host, 1 WHERE OLD.profile != NEW.profile OR OLD.host != NEW.host
+					ON CONFLICT (profile, host) DO UPDATE SET version = version + 1;
+				INSERT INTO cookie_jar_version (profile, host, version) VALUES (NEW.profile, NEW.host, 1)
+					ON CONFLICT (profile, host) DO UPDATE SET version = version + 1;
+			END;
+		CREATE TRIGGER trg_cookie_jar_delete AFTER DELETE ON cookie_jar
+			BEGIN
+				INSERT INTO cookie_jar_version (profile, host, version) VALUES (OLD.profile, OLD.host, 1)
+					ON CONFLICT (profile, host) DO UPDATE SET version = version + 1;
+			END;
+	`
+	// addCookieJarCountDDL adds a count of each row's cookies, so that
+	// they can be counted without being loaded. It is NULL until the
+	// row is next written, or counted by CookieCount.
+	addCookieJarCountDDL = `
+		ALTER TABLE cookie_jar ADD COLUMN cookie_count INTEGER;
+	`
+	createCookieJarAuditDDL = `
+		CREATE TABLE IF NOT EXISTS cookie_jar_audit (
+			id				INTEGER NOT NULL,
+			profile			TEXT NOT NULL DEFAULT '',
+			host			TEXT NOT NULL,
+			kind			TEXT NOT NULL,
+			name			TEXT NOT NULL,
+			domain			TEXT NOT NULL,
+			path			TEXT NOT NULL,
+			old_hash		TEXT NOT NULL,
+			new_hash		TEXT NOT NULL,
+			url				TEXT NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_cookie_jar_audit_host ON cookie_jar_audit(profile, host, created_at);
+	`
 	dropCookieJarDDL = `
+		DROP INDEX IF EXISTS idx_cookie_jar_audit_host;
+		DROP TABLE IF EXISTS cookie_jar_audit;
+		DROP TRIGGER IF EXISTS trg_cookie_jar_insert;
+		DROP TRIGGER IF EXISTS trg_cookie_jar_update;
+		DROP TRIGGER IF EXISTS trg_cookie_jar_delete;
+		DROP TABLE IF EXISTS cookie_jar_version;
 		DROP INDEX IF EXISTS idx_cookie_jar_created_at;
 		DROP INDEX IF EXISTS idx_cookie_jar_modified_at;
 		DROP TABLE IF EXISTS cookie_jar;
 	`
 )
 
+// cookieJarMigrations are the steps that create and upgrade the cookie_jar schema.
+var cookieJarMigrations = []migration{
+	execMigration(createCookieJarDDL),
+	addCookieJarProfile,
+	execMigration(createCookieJarVersionDDL),
+	execMigration(createCookieJarAuditDDL),
+	execMigration(addCookieJarHostVersionDDL),
+	execMigration(addCookieJarCountDDL),
+}
+
+// addCookieJarProfile adds the profile column, unless a database
+// created before versions were recorded already has it.
+func addCookieJarProfile(ctx context.Context, tx *sqlx.Tx) error {
+	ok, err := hasColumn(ctx, tx, "cookie_jar", "profile")
+	if err != nil || ok {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, addCookieJarProfileDDL)
+	return err
+}
+
 // CollyPersistentCookieJar is like http.CookieJar but with returned errors.
 type CollyPersistentCookieJar interface {
 	Init() error
@@ -39,180 +157,457 @@ type CollyPersistentCookieJar interface {
 	SetCookies(u *url.URL, cookies []*http.Cookie) error
 }
 
-// TODO(js) It would be much better if every implementation of a
-// CookieJar/CookieStore didn't need to implement its own serialisation.
-// In reality, this would be a cleaner interface to the cookie store:-
-//
-// type CollyCookieStore interface {
-// 	Init() error
-// 	Destroy() error
-// 	Cookies(host string) (string, error)
-// 	SetCookies(host string, cs string) error
-// }
-
 var _ CollyPersistentCookieJar = &CookieJar{}
 
+// CookieJar is a persistent cookie jar backed by an SQLite database.
+// It is a CookieStoreJar over an SQLiteCookieStore.
+type CookieJar struct {
+	*SQLiteCookieStore
+	*CookieStoreJar
+
+	mu          sync.Mutex
+	profiles    map[string]*CookieJar
+	cacheConfig *CookieCacheConfig
+}
+
+func NewCookieJar(path string) *CookieJar {
+	s := NewSQLiteCookieStore(path)
+	j := &CookieJar{
+		SQLiteCookieStore: s,
+		CookieStoreJar:    NewCookieStoreJar(s),
+	}
+	return j
+}
+
+func (j *CookieJar) Init() error {
+	return j.CookieStoreJar.Init()
+}
+
+func (j *CookieJar) Destroy() error {
+	return j.CookieStoreJar.Destroy()
+}
+
+func (j *CookieJar) Cookies(u *url.URL) ([]*http.Cookie, error) {
+	return j.CookieStoreJar.Cookies(u)
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) error {
+	return j.CookieStoreJar.SetCookies(u, cookies)
+}
+
+// InitContext is like Init but includes a context.
+func (j *CookieJar) InitContext(ctx context.Context) error {
+	return j.CookieStoreJar.InitContext(ctx)
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (j *CookieJar) DestroyContext(ctx context.Context) error {
+	return j.CookieStoreJar.DestroyContext(ctx)
+}
+
+// CookiesContext is like Cookies but includes a context.
+func (j *CookieJar) CookiesContext(ctx context.Context, u *url.URL) ([]*http.Cookie, error) {
+	return j.CookieStoreJar.CookiesContext(ctx, u)
+}
+
+// SetCookiesContext is like SetCookies but includes a context.
+func (j *CookieJar) SetCookiesContext(ctx context.Context, u *url.URL, cookies []*http.Cookie) error {
+	return j.CookieStoreJar.SetCookiesContext(ctx, u, cookies)
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// Cookies held by the cache's write-behind are flushed first.
+// It is safe to call while the jar is in use.
+func (j *CookieJar) Backup(destPath string, progress func(BackupProgress)) error {
+	return j.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (j *CookieJar) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	err := j.FlushContext(ctx)
+	if err != nil {
+		return err
+	}
+	return j.SQLiteCookieStore.BackupContext(ctx, destPath, progress)
+}
+
+var _ VersionedCookieStore = &SQLiteCookieStore{}
+var _ ContextCookieStore = &SQLiteCookieStore{}
+var _ TxCookieStore = &SQLiteCookieStore{}
+
 type cookieJarRecord struct {
+	Profile    string     `db:"profile"`
 	Host       string     `db:"host"`
 	Cookies    string     `db:"cookies"`
+	Count      *int       `db:"cookie_count"`
 	ModifiedAt *time.Time `db:"modified_at"`
 	CreatedAt  time.Time  `db:"created_at"`
 }
 
-type CookieJar struct {
+// SQLiteCookieStore is a CookieStore backed by an SQLite database.
+type SQLiteCookieStore struct {
 	Path string
-	mu   sync.RWMutex
+	// ProfileName is the cookie profile that the store reads and writes.
+	// The default profile has an empty name.
+	ProfileName string
+	// Keys, if set, is used to encrypt cookies at rest.
+	Keys KeyProvider
 }
 
-func NewCookieJar(path string) *CookieJar {
-	j := &CookieJar{
+func NewSQLiteCookieStore(path string) *SQLiteCookieStore {
+	s := &SQLiteCookieStore{
 		Path: path + ".sqlite",
 	}
-	return j
+	return s
 }
 
-func (j *CookieJar) Init() error {
-	err := ensurePathExists(j.Path)
+func (s *SQLiteCookieStore) Init() error {
+	return s.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (s *SQLiteCookieStore) InitContext(ctx context.Context) error {
+	err := ensurePathExists(s.Path)
 	if err != nil {
 		return err
 	}
-	db, err := j.connect()
+	db, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(createCookieJarDDL)
-	return err
+	return migrate(ctx, db, "cookie_jar", cookieJarMigrations)
 }
 
-func (j *CookieJar) Destroy() error {
-	db, err := j.connect()
+func (s *SQLiteCookieStore) Destroy() error {
+	return s.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (s *SQLiteCookieStore) DestroyContext(ctx context.Context) error {
+	db, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	j.mu.Lock()
-	defer j.mu.Unlock()
-	_, err = db.Exec(dropCookieJarDDL)
+	_, err = db.ExecContext(ctx, dropCookieJarDDL)
 	if err != nil {
 		return err
 	}
-	return removeIfNoTables(db, j.Path)
+	err = forgetSchema(ctx, db, "cookie_jar")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, s.Path)
 }
 
-func (j *CookieJar) Cookies(u *url.URL) ([]*http.Cookie, error) {
-	db, err := j.connect()
+func (s *SQLiteCookieStore) Cookies(host string) (string, error) {
+	return s.CookiesContext(context.Background(), host)
+}
+
+// CookiesContext is like Cookies but includes a context.
+func (s *SQLiteCookieStore) CookiesContext(ctx context.Context, host string) (string, error) {
+	db, err := s.connect(ctx)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer db.Close()
+	return s.cookies(ctx, db, host)
+}
 
-	cookiesStr := ""
-	j.mu.RLock()
-	err = db.Get(&cookiesStr, "SELECT cookies FROM cookie_jar WHERE host = ?", u.Host)
-	j.mu.RUnlock()
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
+func (s *SQLiteCookieStore) SetCookies(host string, cs string) error {
+	return s.SetCookiesContext(context.Background(), host, cs)
+}
+
+// SetCookiesContext is like SetCookies but includes a context.
+func (s *SQLiteCookieStore) SetCookiesContext(ctx context.Context, host string, cs string) error {
+	db, err := s.connect(ctx)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	defer db.Close()
+	return s.setCookies(ctx, db, host, cs)
+}
 
-	// Parse raw cookies string to []*http.Cookie.
-	cookies := unstringify(cookiesStr)
+func (s *SQLiteCookieStore) Hosts() ([]string, error) {
+	return s.HostsContext(context.Background())
+}
 
-	// Filter.
-	now := time.Now()
-	cnew := make([]*http.Cookie, 0, len(cookies))
-	for _, c := range cookies {
-		// Drop expired cookies.
-		if c.RawExpires != "" && c.Expires.Before(now) {
-			continue
-		}
-		// Drop secure cookies if not over https.
-		if c.Secure && u.Scheme != "https" {
-			continue
-		}
-		cnew = append(cnew, c)
+// HostsContext is like Hosts but includes a context.
+func (s *SQLiteCookieStore) HostsContext(ctx context.Context) ([]string, error) {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return cnew, nil
+	defer db.Close()
+	return s.hosts(ctx, db)
 }
 
-func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) error {
-	db, err := j.connect()
+// UpdateCookies calls fn with a transaction on the store, committing it
+// if fn returns nil, and otherwise rolling it back. The transaction takes
+// the database's write lock when it begins, so that the cookies it reads
+// cannot be changed by other writers, including other processes, before
+// it commits. Changes recorded with the transaction's RecordCookieChanges
+// are committed with the cookies.
+func (s *SQLiteCookieStore) UpdateCookies(fn func(tx CookieTx) error) error {
+	return s.UpdateCookiesContext(context.Background(), fn)
+}
+
+// UpdateCookiesContext is like UpdateCookies but includes a context.
+func (s *SQLiteCookieStore) UpdateCookiesContext(ctx context.Context, fn func(tx CookieTx) error) error {
+	db, err := s.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(&sqliteCookieTx{ctx: ctx, s: s, tx: tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	// We need to use a write lock to prevent a race in the db:
-	// if two callers set cookies in a very small window of time,
-	// it is possible to drop the new cookies from one caller
-	// ('last update wins' == best avoided).
-	j.mu.Lock()
-	defer j.mu.Unlock()
+func (s *SQLiteCookieStore) cookies(ctx context.Context, q sqlx.QueryerContext, host string) (string, error) {
+	cs := ""
+	err := sqlx.GetContext(ctx, q, &cs, "SELECT cookies FROM cookie_jar WHERE profile = ? AND host = ?", s.ProfileName, host)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return decryptText(s.Keys, cs, cookieAAD(s.ProfileName, host))
+}
+
+func (s *SQLiteCookieStore) setCookies(ctx context.Context, e sqlx.ExtContext, host string, cs string) error {
+	count := countStored(cs)
+	if s.Keys != nil {
+		var err error
+		cs, err = encryptText(s.Keys, cs, cookieAAD(s.ProfileName, host))
+		if err != nil {
+			return err
+		}
+	}
 
 	var r cookieJarRecord
-	err = db.Get(&r, "SELECT * FROM cookie_jar WHERE host = ?", u.Host)
+	err := sqlx.GetContext(ctx, e, &r, "SELECT * FROM cookie_jar WHERE profile = ? AND host = ?", s.ProfileName, host)
 	if err == sql.ErrNoRows {
 		// Insert new record.
-		r.Host = u.Host
-		r.Cookies = stringify(cookies)
+		r.Profile = s.ProfileName
+		r.Host = host
+		r.Cookies = cs
+		r.Count = &count
 		r.CreatedAt = time.Now()
-		_, err = db.NamedExec("INSERT INTO cookie_jar (host, cookies, created_at) VALUES (:host, :cookies, :created_at)", r)
+		_, err = sqlx.NamedExecContext(ctx, e, "INSERT INTO cookie_jar (profile, host, cookies, cookie_count, created_at) VALUES (:profile, :host, :cookies, :cookie_count, :created_at)", r)
 		return err
 	}
 	if err != nil {
 		return err
 	}
 	// Update existing record.
+	now := time.Now()
+	r.ModifiedAt = &now
+	r.Cookies = cs
+	r.Count = &count
+	_, err = sqlx.NamedExecContext(ctx, e, "UPDATE cookie_jar SET cookies = :cookies, cookie_count = :cookie_count, modified_at = :modified_at WHERE profile = :profile AND host = :host", r)
+	return err
+}
+
+func (s *SQLiteCookieStore) hosts(ctx context.Context, q sqlx.QueryerContext) ([]string, error) {
+	var hosts []string
+	err := sqlx.SelectContext(ctx, q, &hosts, "SELECT host FROM cookie_jar WHERE profile = ? ORDER BY host", s.ProfileName)
+	return hosts, err
+}
 
-	// Merge existing cookies, new cookies have precendence.
-	cnew := make([]*http.Cookie, len(cookies))
-	copy(cnew, cookies)
-	existing := unstringify(r.Cookies)
-	for _, c := range existing {
-		if !contains(cnew, c.Name) {
-			cnew = append(cnew, c)
+// sqliteCookieTx is a CookieTx on an SQLiteCookieStore.
+type sqliteCookieTx struct {
+	ctx context.Context
+	s   *SQLiteCookieStore
+	tx  *sqlx.Tx
+}
+
+var _ CookieAuditor = &sqliteCookieTx{}
+
+func (t *sqliteCookieTx) Cookies(host string) (string, error) {
+	return t.s.cookies(t.ctx, t.tx, host)
+}
+
+func (t *sqliteCookieTx) SetCookies(host string, cs string) error {
+	return t.s.setCookies(t.ctx, t.tx, host, cs)
+}
+
+func (t *sqliteCookieTx) Hosts() ([]string, error) {
+	return t.s.hosts(t.ctx, t.tx)
+}
+
+func (t *sqliteCookieTx) RecordCookieChanges(changes []CookieChange) error {
+	return t.s.recordCookieChanges(t.ctx, t.tx, changes)
+}
+
+func (t *sqliteCookieTx) CookieCount() (int, error) {
+	return t.s.cookieCount(t.ctx, t.tx)
+}
+
+func (t *sqliteCookieTx) Version(host string) (int64, error) {
+	return t.s.version(t.ctx, t.tx, host)
+}
+
+// RotateKeys re-encrypts the cookies of every profile with the current key
+// of Keys. Keys must still be able to provide the keys they were encrypted with.
+// Cookies that are not yet encrypted are encrypted.
+//
+// Rows are re-encrypted in batches, each in its own transaction, so that
+// other writers are not held up for long. If RotateKeys fails part way,
+// it may be called again.
+func (s *SQLiteCookieStore) RotateKeys() error {
+	return s.RotateKeysContext(context.Background())
+}
+
+// RotateKeysContext is like RotateKeys but includes a context.
+func (s *SQLiteCookieStore) RotateKeysContext(ctx context.Context) error {
+	if s.Keys == nil {
+		return fmt.Errorf("collysqlite: no KeyProvider is set")
+	}
+	db, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var last *cookieJarRecord
+	for {
+		last, err = s.rotateKeys(ctx, db, last)
+		if err != nil || last == nil {
+			return err
 		}
 	}
+}
 
-	now := time.Now()
-	r.ModifiedAt = &now
-	r.Cookies = stringify(cnew)
-	_, err = db.NamedExec("UPDATE cookie_jar SET cookies = :cookies, modified_at = :modified_at WHERE host = :host", r)
-	return err
+// rotateKeys re-encrypts the batch of rows that follows last, or the first
+// batch if last is nil, and returns the last row of the batch, or nil
+// if there were no more rows.
+func (s *SQLiteCookieStore) rotateKeys(ctx context.Context, db *sqlx.DB, last *cookieJarRecord) (*cookieJarRecord, error) {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var rs []cookieJarRecord
+	if last == nil {
+		err = tx.SelectContext(ctx, &rs, "SELECT * FROM cookie_jar ORDER BY profile, host LIMIT ?", rotateKeysBatchSize)
+	} else {
+		err = tx.SelectContext(ctx, &rs, "SELECT * FROM cookie_jar WHERE profile > ? OR (profile = ? AND host > ?) ORDER BY profile, host LIMIT ?", last.Profile, last.Profile, last.Host, rotateKeysBatchSize)
+	}
+	if err != nil || len(rs) == 0 {
+		return nil, err
+	}
+	for _, r := range rs {
+		aad := cookieAAD(r.Profile, r.Host)
+		cs, err := decryptText(s.Keys, r.Cookies, aad)
+		if err != nil {
+			return nil, err
+		}
+		cs, err = encryptText(s.Keys, cs, aad)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.ExecContext(ctx, "UPDATE cookie_jar SET cookies = ? WHERE profile = ? AND host = ?", cs, r.Profile, r.Host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &rs[len(rs)-1], tx.Commit()
+}
+
+// cookieAAD returns the additional authenticated data that binds
+// encrypted cookies to their profile and host, so that they cannot be
+// moved to another row undetected.
+func cookieAAD(profile, host string) string {
+	return profile + "\x00" + host
+}
+
+// CookieCount returns the number of cookies held by the store's profile,
+// including any that have expired but are yet to be removed.
+func (s *SQLiteCookieStore) CookieCount() (int, error) {
+	return s.CookieCountContext(context.Background())
 }
 
-func contains(cookies []*http.Cookie, name string) bool {
-	for _, c := range cookies {
-		if c.Name == name {
-			return true
+// CookieCountContext is like CookieCount but includes a context.
+func (s *SQLiteCookieStore) CookieCountContext(ctx context.Context) (int, error) {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return s.cookieCount(ctx, db)
+}
+
+func (s *SQLiteCookieStore) cookieCount(ctx context.Context, e sqlx.ExtContext) (int, error) {
+	// Count any rows written before counts were kept.
+	var rs []cookieJarRecord
+	err := sqlx.SelectContext(ctx, e, &rs, "SELECT * FROM cookie_jar WHERE profile = ? AND cookie_count IS NULL", s.ProfileName)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range rs {
+		cs, err := decryptText(s.Keys, r.Cookies, cookieAAD(r.Profile, r.Host))
+		if err != nil {
+			return 0, err
+		}
+		_, err = e.ExecContext(ctx, "UPDATE cookie_jar SET cookie_count = ? WHERE profile = ? AND host = ? AND cookie_count IS NULL", countStored(cs), r.Profile, r.Host)
+		if err != nil {
+			return 0, err
 		}
 	}
-	return false
+	var n int
+	err = sqlx.GetContext(ctx, e, &n, "SELECT COALESCE(SUM(cookie_count), 0) FROM cookie_jar WHERE profile = ?", s.ProfileName)
+	return n, err
 }
 
-func stringify(cookies []*http.Cookie) string {
-	// Stringify cookies.
-	cs := make([]string, len(cookies))
-	for i, c := range cookies {
-		cs[i] = c.String()
+// Version returns a counter for the given host of the store's profile
+// that is incremented by every change to its cookies, made by any process.
+func (s *SQLiteCookieStore) Version(host string) (int64, error) {
+	return s.VersionContext(context.Background(), host)
+}
+
+// VersionContext is like Version but includes a context.
+func (s *SQLiteCookieStore) VersionContext(ctx context.Context, host string) (int64, error) {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return 0, err
 	}
-	return strings.Join(cs, "\n")
+	defer db.Close()
+	return s.version(ctx, db, host)
 }
 
-func unstringify(s string) []*http.Cookie {
-	h := http.Header{}
-	for _, c := range strings.Split(s, "\n") {
-		h.Add("Set-Cookie", c)
+func (s *SQLiteCookieStore) version(ctx context.Context, q sqlx.QueryerContext, host string) (int64, error) {
+	var v int64
+	err := sqlx.GetContext(ctx, q, &v, "SELECT version FROM cookie_jar_version WHERE profile = ? AND host = ?", s.ProfileName, host)
+	if err == sql.ErrNoRows {
+		return 0, nil
 	}
-	r := http.Response{Header: h}
-	return r.Cookies()
+	return v, err
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the store is in use.
+func (s *SQLiteCookieStore) Backup(destPath string, progress func(BackupProgress)) error {
+	return s.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (s *SQLiteCookieStore) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, s.Path, destPath, progress)
 }
 
-func (j *CookieJar) connect() (*sqlx.DB, error) {
-	return sqlx.Connect("sqlite3", j.Path)
+func (s *SQLiteCookieStore) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", "file:"+s.Path+"?_busy_timeout="+busyTimeout+"&_txlock=immediate")
 }
 
 // TODO Eventually remove ExplodingCookieJar, when Colly handles PersistentCookieJars or CookieStore.
@@ -236,33 +631,239 @@ var _ http.CookieJar = &ExplodingCookieJar{}
 // a CollyPersistentCookieJar (which does return errors) - see CollyCookieJarAdapter
 // for the implementation - but vice versa ignores error states and will eventually
 // explode / end up in an inconsistent system state.
+//
+// The exploding behaviour can be tamed by setting OnError and/or Fallback.
+// If either is set, errors no longer exit the process: OnError is called with
+// the name of the failing operation, and the Fallback jar is used in place of
+// the database until it recovers. When OnError is set without a Fallback,
+// a MemoryCookieJar is used. On the first successful operation after an
+// outage, LastError is cleared, and cookies set on a MemoryCookieJar Fallback
+// during the outage are written back to the database.
 type ExplodingCookieJar struct {
 	Jar *CookieJar
+	// OnError, if set, is called whenever the wrapped jar returns an error.
+	// op is either "Cookies" or "SetCookies".
+	OnError func(op string, u *url.URL, err error)
+	// Fallback, if set, is used while the wrapped jar is returning errors.
+	// Only the cookies set on a MemoryCookieJar are written back on recovery.
+	Fallback http.CookieJar
+
+	mu       sync.Mutex
+	lastErr  error
+	fallback *MemoryCookieJar
+	profiles map[string]*ExplodingCookieJar
 }
 
 func (j *ExplodingCookieJar) Init() error {
-	return j.Jar.Init()
+	return j.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (j *ExplodingCookieJar) InitContext(ctx context.Context) error {
+	return j.Jar.InitContext(ctx)
 }
 
 func (j *ExplodingCookieJar) Destroy() error {
-	return j.Jar.Destroy()
+	return j.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (j *ExplodingCookieJar) DestroyContext(ctx context.Context) error {
+	return j.Jar.DestroyContext(ctx)
+}
+
+func (j *ExplodingCookieJar) Close() error {
+	return j.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but includes a context.
+func (j *ExplodingCookieJar) CloseContext(ctx context.Context) error {
+	return closeIfCloser(ctx, j.Jar)
+}
+
+// Backup is like CookieJar.Backup, its error is returned as usual.
+func (j *ExplodingCookieJar) Backup(destPath string, progress func(BackupProgress)) error {
+	return j.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (j *ExplodingCookieJar) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return j.Jar.BackupContext(ctx, destPath, progress)
 }
 
 func (j *ExplodingCookieJar) Cookies(u *url.URL) []*http.Cookie {
-	// TODO We have no way of returning a db error?
-	c, err := j.Jar.Cookies(u)
+	return j.CookiesContext(context.Background(), u)
+}
+
+// CookiesContext is like Cookies but includes a context.
+// Errors, including those due to ctx, are handled as by Cookies.
+func (j *ExplodingCookieJar) CookiesContext(ctx context.Context, u *url.URL) []*http.Cookie {
+	c, err := j.Jar.CookiesContext(ctx, u)
 	if err != nil {
-		log.Fatalf("error %s", err)
+		fb := j.handleError("Cookies", u, err, nil)
+		if fb != nil {
+			return fb.Cookies(u)
+		}
+		return nil
+	}
+	if j.recover(ctx, u) {
+		// Include any cookies written back from the fallback.
+		c, err = j.Jar.CookiesContext(ctx, u)
+		if err != nil {
+			fb := j.handleError("Cookies", u, err, nil)
+			if fb != nil {
+				return fb.Cookies(u)
+			}
+			return nil
+		}
 	}
 	return c
 }
 
 func (j *ExplodingCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
-	// TODO We have no way of returning a db error?
-	err := j.Jar.SetCookies(u, cookies)
+	j.SetCookiesContext(context.Background(), u, cookies)
+}
+
+// SetCookiesContext is like SetCookies but includes a context.
+// Errors, including those due to ctx, are handled as by SetCookies.
+func (j *ExplodingCookieJar) SetCookiesContext(ctx context.Context, u *url.URL, cookies []*http.Cookie) {
+	err := j.Jar.SetCookiesContext(ctx, u, cookies)
 	if err != nil {
+		j.handleError("SetCookies", u, err, cookies)
+		return
+	}
+	j.recover(ctx, u)
+}
+
+// LastError returns the most recent error returned by the wrapped jar,
+// or nil if there has been none since it last succeeded.
+func (j *ExplodingCookieJar) LastError() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastErr
+}
+
+// handleError records err, and sets cookies, if any, on the fallback jar,
+// which it returns, or nil if there is none.
+func (j *ExplodingCookieJar) handleError(op string, u *url.URL, err error, cookies []*http.Cookie) http.CookieJar {
+	if j.OnError == nil && j.Fallback == nil {
 		log.Fatalf("error %s", err)
 	}
+	// Set cookies on the fallback under the lock,
+	// so that a concurrent recovery cannot miss them.
+	j.mu.Lock()
+	j.lastErr = err
+	fb := j.fallbackJar()
+	if cookies != nil {
+		fb.SetCookies(u, cookies)
+	}
+	j.mu.Unlock()
+	if j.OnError != nil {
+		j.OnError(op, u, err)
+	}
+	return fb
+}
+
+// fallbackJar returns Fallback, or else the default MemoryCookieJar.
+// The caller must hold j.mu.
+func (j *ExplodingCookieJar) fallbackJar() http.CookieJar {
+	if j.Fallback != nil {
+		return j.Fallback
+	}
+	if j.fallback == nil {
+		j.fallback = NewMemoryCookieJar()
+	}
+	return j.fallback
+}
+
+// recover is called after the wrapped jar succeeds. If it had been failing,
+// LastError is cleared, and cookies set on a MemoryCookieJar fallback are
+// written back to it. It reports whether any cookies were written back.
+func (j *ExplodingCookieJar) recover(ctx context.Context, u *url.URL) bool {
+	j.mu.Lock()
+	if j.lastErr == nil {
+		j.mu.Unlock()
+		return false
+	}
+	wrote := false
+	var err error
+	if mj, ok := j.fallbackJar().(*MemoryCookieJar); ok {
+		err = mj.replay(ctx, func(u *url.URL, cookies []*http.Cookie) error {
+			wrote = true
+			return j.Jar.SetCookiesContext(ctx, u, cookies)
+		})
+	}
+	j.lastErr = err
+	j.mu.Unlock()
+	if err != nil {
+		if j.OnError != nil {
+			j.OnError("SetCookies", u, err)
+		}
+		return false
+	}
+	return wrote
+}
+
+var _ http.CookieJar = &MemoryCookieJar{}
+
+// MemoryCookieJar is an http.CookieJar held in memory, for use as the
+// Fallback of an ExplodingCookieJar. Its zero value is ready to use.
+type MemoryCookieJar struct {
+	mu  sync.Mutex
+	jar *CookieStoreJar
+}
+
+func NewMemoryCookieJar() *MemoryCookieJar {
+	return &MemoryCookieJar{}
+}
+
+// storeJar returns the jar holding the cookies.
+// The caller must hold j.mu.
+func (j *MemoryCookieJar) storeJar() *CookieStoreJar {
+	if j.jar == nil {
+		j.jar = NewCookieStoreJar(NewMemoryCookieStore())
+	}
+	return j.jar
+}
+
+func (j *MemoryCookieJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// A MemoryCookieStore never fails.
+	c, _ := j.storeJar().Cookies(u)
+	return c
+}
+
+func (j *MemoryCookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.storeJar().SetCookies(u, cookies)
+}
+
+// replay calls fn with the unexpired cookies held for each host, and then,
+// if fn succeeds for every host, discards them.
+func (j *MemoryCookieJar) replay(ctx context.Context, fn func(u *url.URL, cookies []*http.Cookie) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var hosts []string
+	byHost := make(map[string][]*http.Cookie)
+	err := j.storeJar().exportCookies(ctx, func(host string, c *http.Cookie) {
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], c)
+	})
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		err = fn(&url.URL{Scheme: "http", Host: host}, byHost[host])
+		if err != nil {
+			return err
+		}
+	}
+	j.jar = nil
+	return nil
 }
 
 var _ CollyPersistentCookieJar = &CollyCookieJarAdapter{}
@@ -272,14 +873,34 @@ type CollyCookieJarAdapter struct {
 	Jar http.CookieJar
 }
 
+// Init calls Init on the wrapped Jar if it is an Initer.
 func (j *CollyCookieJarAdapter) Init() error {
-	// TODO Check if wrapped Jar is an Initer.
-	return nil
+	return j.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (j *CollyCookieJarAdapter) InitContext(ctx context.Context) error {
+	return initIfIniter(ctx, j.Jar)
 }
 
+// Destroy calls Destroy on the wrapped Jar if it is a Destroyer.
 func (j *CollyCookieJarAdapter) Destroy() error {
-	// TODO Check if wrapped Jar is a Destroyer.
-	return nil
+	return j.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (j *CollyCookieJarAdapter) DestroyContext(ctx context.Context) error {
+	return destroyIfDestroyer(ctx, j.Jar)
+}
+
+// Close calls Close on the wrapped Jar if it is a Closer.
+func (j *CollyCookieJarAdapter) Close() error {
+	return j.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but includes a context.
+func (j *CollyCookieJarAdapter) CloseContext(ctx context.Context) error {
+	return closeIfCloser(ctx, j.Jar)
 }
 
 func (j *CollyCookieJarAdapter) Cookies(u *url.URL) ([]*http.Cookie, error) {
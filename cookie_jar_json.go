@@ -0,0 +1,159 @@
+package collysqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jsonCookie is the JSON shape used by browser extensions
+// such as EditThisCookie when exporting cookies.
+type jsonCookie struct {
+	Domain         string  `json:"domain"`
+	ExpirationDate float64 `json:"expirationDate,omitempty"`
+	HostOnly       bool    `json:"hostOnly"`
+	HttpOnly       bool    `json:"httpOnly"`
+	Name           string  `json:"name"`
+	Path           string  `json:"path"`
+	SameSite       string  `json:"sameSite"`
+	Secure         bool    `json:"secure"`
+	Session        bool    `json:"session"`
+	Value          string  `json:"value"`
+}
+
+// ImportJSON reads a JSON array of cookies, as exported by browser
+// extensions such as EditThisCookie, from r, and stores them in the jar,
+// grouped by host.
+func (j *CookieStoreJar) ImportJSON(r io.Reader) error {
+	return j.ImportJSONContext(context.Background(), r)
+}
+
+// ImportJSONContext is like ImportJSON but includes a context.
+func (j *CookieStoreJar) ImportJSONContext(ctx context.Context, r io.Reader) error {
+	var jcs []jsonCookie
+	err := json.NewDecoder(r).Decode(&jcs)
+	if err != nil {
+		return fmt.Errorf("collysqlite: json cookies: %s", err)
+	}
+	hosts := make([]string, len(jcs))
+	cookies := make([]*http.Cookie, len(jcs))
+	for i, jc := range jcs {
+		host, c, err := jc.toCookie()
+		if err != nil {
+			return fmt.Errorf("collysqlite: json cookie %d: %s", i, err)
+		}
+		hosts[i] = host
+		cookies[i] = c
+	}
+	return j.importCookies(ctx, hosts, cookies)
+}
+
+// ExportJSON writes all unexpired cookies held in the jar to w,
+// as a JSON array in the format used by browser extensions
+// such as EditThisCookie.
+func (j *CookieStoreJar) ExportJSON(w io.Writer) error {
+	return j.ExportJSONContext(context.Background(), w)
+}
+
+// ExportJSONContext is like ExportJSON but includes a context.
+func (j *CookieStoreJar) ExportJSONContext(ctx context.Context, w io.Writer) error {
+	jcs := make([]jsonCookie, 0)
+	err := j.exportCookies(ctx, func(host string, c *http.Cookie) {
+		jcs = append(jcs, newJSONCookie(host, c))
+	})
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jcs)
+}
+
+func (jc *jsonCookie) toCookie() (string, *http.Cookie, error) {
+	host := strings.TrimPrefix(jc.Domain, ".")
+	if host == "" {
+		return "", nil, fmt.Errorf("empty domain")
+	}
+	if jc.Name == "" {
+		return "", nil, fmt.Errorf("empty cookie name")
+	}
+	sameSite, err := parseJSONSameSite(jc.SameSite)
+	if err != nil {
+		return "", nil, err
+	}
+	if jc.ExpirationDate < 0 || math.IsNaN(jc.ExpirationDate) || math.IsInf(jc.ExpirationDate, 0) || jc.ExpirationDate > maxCookieExpiry {
+		return "", nil, fmt.Errorf("invalid expirationDate %v", jc.ExpirationDate)
+	}
+	c := &http.Cookie{
+		Name:     jc.Name,
+		Value:    jc.Value,
+		Path:     jc.Path,
+		Secure:   jc.Secure,
+		HttpOnly: jc.HttpOnly,
+		SameSite: sameSite,
+	}
+	if !jc.HostOnly {
+		c.Domain = host
+	}
+	if !jc.Session && jc.ExpirationDate > 0 {
+		sec, frac := math.Modf(jc.ExpirationDate)
+		c.Expires = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	}
+	return host, c, nil
+}
+
+func newJSONCookie(host string, c *http.Cookie) jsonCookie {
+	jc := jsonCookie{
+		Domain:   host,
+		HostOnly: true,
+		HttpOnly: c.HttpOnly,
+		Name:     c.Name,
+		Path:     c.Path,
+		SameSite: formatJSONSameSite(c.SameSite),
+		Secure:   c.Secure,
+		Session:  c.Expires.IsZero(),
+		Value:    c.Value,
+	}
+	if c.Domain != "" {
+		jc.Domain = "." + strings.TrimPrefix(c.Domain, ".")
+		jc.HostOnly = false
+	}
+	if jc.Path == "" {
+		jc.Path = "/"
+	}
+	if !jc.Session {
+		jc.ExpirationDate = float64(c.Expires.Unix())
+	}
+	return jc
+}
+
+func parseJSONSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "", "unspecified":
+		return 0, nil
+	case "no_restriction", "none":
+		return http.SameSiteNoneMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	}
+	return 0, fmt.Errorf("invalid sameSite %q", s)
+}
+
+func formatJSONSameSite(s http.SameSite) string {
+	switch s {
+	case http.SameSiteNoneMode:
+		return "no_restriction"
+	case http.SameSiteLaxMode:
+		return "lax"
+	case http.SameSiteStrictMode:
+		return "strict"
+	}
+	return "unspecified"
+}
@@ -0,0 +1,139 @@
+package collysqlite_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieJar JSON", func() {
+
+	const cookiesJSON = `[
+		{
+			"domain": ".example.org",
+			"expirationDate": 4102444800.5,
+			"hostOnly": false,
+			"httpOnly": true,
+			"name": "cookie1_name",
+			"path": "/",
+			"sameSite": "lax",
+			"secure": true,
+			"session": false,
+			"storeId": "0",
+			"value": "cookie1_value",
+			"id": 1
+		},
+		{
+			"domain": "example.org",
+			"hostOnly": true,
+			"httpOnly": false,
+			"name": "cookie2_name",
+			"path": "/account",
+			"sameSite": "unspecified",
+			"secure": false,
+			"session": true,
+			"storeId": "0",
+			"value": "cookie2_value",
+			"id": 2
+		}
+	]`
+
+	It("should import JSON", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.ImportJSON(strings.NewReader(cookiesJSON))).To(BeNil())
+
+		u, _ := url.Parse("https://example.org")
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(2))
+		sgot := toStrings(got)
+		Expect(sgot).To(ContainElement("cookie1_name=cookie1_value; Path=/; Domain=example.org; Expires=Fri, 01 Jan 2100 00:00:00 GMT; HttpOnly; Secure; SameSite=Lax"))
+		Expect(sgot).To(ContainElement("cookie2_name=cookie2_value; Path=/account"))
+	})
+
+	It("should export JSON", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		u, _ := url.Parse("http://example.org")
+		cookies := []*http.Cookie{
+			&http.Cookie{
+				Name:     "cookie1_name",
+				Value:    "cookie1_value",
+				Path:     "/",
+				Domain:   ".example.org",
+				SameSite: http.SameSiteStrictMode,
+			},
+		}
+		Expect(j.SetCookies(u, cookies)).To(BeNil())
+
+		var buf bytes.Buffer
+		Expect(j.ExportJSON(&buf)).To(BeNil())
+		var got []map[string]interface{}
+		Expect(json.Unmarshal(buf.Bytes(), &got)).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0]).To(Equal(map[string]interface{}{
+			"domain":   ".example.org",
+			"hostOnly": false,
+			"httpOnly": false,
+			"name":     "cookie1_name",
+			"path":     "/",
+			"sameSite": "strict",
+			"secure":   false,
+			"session":  true,
+			"value":    "cookie1_value",
+		}))
+	})
+
+	It("should round trip JSON", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.ImportJSON(strings.NewReader(cookiesJSON))).To(BeNil())
+		var buf1 bytes.Buffer
+		Expect(j.ExportJSON(&buf1)).To(BeNil())
+		Expect(j.ImportJSON(bytes.NewReader(buf1.Bytes()))).To(BeNil())
+		var buf2 bytes.Buffer
+		Expect(j.ExportJSON(&buf2)).To(BeNil())
+		Expect(buf2.String()).To(Equal(buf1.String()))
+	})
+
+	It("should reject invalid JSON", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		bad := []struct {
+			json string
+			msg  string
+		}{
+			{`{"name": "x"}`, "json cookies:"},
+			{`[{"domain": "", "name": "x"}]`, "json cookie 0: empty domain"},
+			{`[{"domain": "example.org", "name": ""}]`, "json cookie 0: empty cookie name"},
+			{`[{"domain": "example.org", "name": "x", "sameSite": "sideways"}]`, "json cookie 0: invalid sameSite \"sideways\""},
+			{`[{"domain": "example.org", "name": "x", "expirationDate": -1}]`, "json cookie 0: invalid expirationDate -1"},
+			{`[{"domain": "example.org", "name": "x", "expirationDate": 1e13}]`, "json cookie 0: invalid expirationDate 1e+13"},
+		}
+		for _, b := range bad {
+			err := j.ImportJSON(strings.NewReader(b.json))
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(b.msg))
+		}
+	})
+})
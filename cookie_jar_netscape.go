@@ -0,0 +1,179 @@
+package collysqlite
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Netscape cookies.txt format, as used by curl and wget.
+//
+// Each line holds seven tab-separated fields:
+//
+//	domain  include-subdomains  path  secure  expiry  name  value
+//
+// Lines starting with '#' are comments, except for lines prefixed with
+// '#HttpOnly_', which mark HttpOnly cookies. An expiry of 0 denotes a
+// session cookie.
+
+const (
+	netscapeHeader         = "# Netscape HTTP Cookie File"
+	netscapeHttpOnlyPrefix = "#HttpOnly_"
+	netscapeFieldCount     = 7
+
+	// maxCookieExpiry is the latest expiry, 9999-12-31T23:59:59Z, that
+	// can be stored; later times cannot be serialised.
+	maxCookieExpiry = 253402300799
+)
+
+// ImportNetscape reads cookies in Netscape cookies.txt format from r,
+// and stores them in the jar, grouped by host.
+func (j *CookieStoreJar) ImportNetscape(r io.Reader) error {
+	return j.ImportNetscapeContext(context.Background(), r)
+}
+
+// ImportNetscapeContext is like ImportNetscape but includes a context.
+func (j *CookieStoreJar) ImportNetscapeContext(ctx context.Context, r io.Reader) error {
+	var hosts []string
+	var cookies []*http.Cookie
+	s := bufio.NewScanner(r)
+	n := 0
+	for s.Scan() {
+		n++
+		line := strings.TrimRight(s.Text(), "\r")
+		host, c, err := parseNetscapeLine(line)
+		if err != nil {
+			return fmt.Errorf("collysqlite: netscape cookies line %d: %s", n, err)
+		}
+		if c == nil {
+			// Blank line or comment.
+			continue
+		}
+		hosts = append(hosts, host)
+		cookies = append(cookies, c)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return j.importCookies(ctx, hosts, cookies)
+}
+
+// ExportNetscape writes all unexpired cookies held in the jar to w,
+// in Netscape cookies.txt format.
+func (j *CookieStoreJar) ExportNetscape(w io.Writer) error {
+	return j.ExportNetscapeContext(context.Background(), w)
+}
+
+// ExportNetscapeContext is like ExportNetscape but includes a context.
+func (j *CookieStoreJar) ExportNetscapeContext(ctx context.Context, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, netscapeHeader)
+	fmt.Fprintln(bw)
+	err := j.exportCookies(ctx, func(host string, c *http.Cookie) {
+		fmt.Fprintln(bw, formatNetscapeLine(host, c))
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// parseNetscapeLine parses a single line of a cookies.txt file.
+// It returns a nil cookie for blank lines and comments.
+func parseNetscapeLine(line string) (string, *http.Cookie, error) {
+	httpOnly := false
+	if strings.HasPrefix(line, netscapeHttpOnlyPrefix) {
+		httpOnly = true
+		line = line[len(netscapeHttpOnlyPrefix):]
+	} else if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	f := strings.Split(line, "\t")
+	if len(f) != netscapeFieldCount {
+		return "", nil, fmt.Errorf("expected %d tab-separated fields, got %d", netscapeFieldCount, len(f))
+	}
+	domain := f[0]
+	host := strings.TrimPrefix(domain, ".")
+	if host == "" {
+		return "", nil, fmt.Errorf("empty domain")
+	}
+	includeSubdomains, err := parseNetscapeBool(f[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid include-subdomains flag: %s", err)
+	}
+	secure, err := parseNetscapeBool(f[3])
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid secure flag: %s", err)
+	}
+	expiry, err := strconv.ParseInt(f[4], 10, 64)
+	if err != nil || expiry < 0 || expiry > maxCookieExpiry {
+		return "", nil, fmt.Errorf("invalid expiry %q", f[4])
+	}
+	if f[5] == "" {
+		return "", nil, fmt.Errorf("empty cookie name")
+	}
+	c := &http.Cookie{
+		Name:     f[5],
+		Value:    f[6],
+		Path:     f[2],
+		Secure:   secure,
+		HttpOnly: httpOnly,
+	}
+	if includeSubdomains {
+		c.Domain = host
+	}
+	if expiry > 0 {
+		c.Expires = time.Unix(expiry, 0).UTC()
+	}
+	return host, c, nil
+}
+
+// formatNetscapeLine formats a cookie stored against the given host
+// as a single line of a cookies.txt file.
+func formatNetscapeLine(host string, c *http.Cookie) string {
+	domain := host
+	includeSubdomains := "FALSE"
+	if c.Domain != "" {
+		domain = "." + strings.TrimPrefix(c.Domain, ".")
+		includeSubdomains = "TRUE"
+	}
+	if c.HttpOnly {
+		domain = netscapeHttpOnlyPrefix + domain
+	}
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	secure := "FALSE"
+	if c.Secure {
+		secure = "TRUE"
+	}
+	var expiry int64
+	if !c.Expires.IsZero() {
+		expiry = c.Expires.Unix()
+	}
+	return strings.Join([]string{
+		domain,
+		includeSubdomains,
+		path,
+		secure,
+		strconv.FormatInt(expiry, 10),
+		c.Name,
+		c.Value,
+	}, "\t")
+}
+
+func parseNetscapeBool(s string) (bool, error) {
+	switch strings.ToUpper(s) {
+	case "TRUE":
+		return true, nil
+	case "FALSE":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected TRUE or FALSE, got %q", s)
+}
@@ -0,0 +1,123 @@
+package collysqlite_test
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieJar Netscape", func() {
+
+	const cookiesTxt = "# Netscape HTTP Cookie File\n" +
+		"# This is a comment.\n" +
+		"\n" +
+		".example.org\tTRUE\t/\tFALSE\t0\tcookie1_name\tcookie1_value\n" +
+		"#HttpOnly_example.org\tFALSE\t/account\tTRUE\t4102444800\tcookie2_name\tcookie2_value\n" +
+		"other.example.com\tFALSE\t/\tFALSE\t0\tcookie3_name\tcookie3_value\n"
+
+	It("should import cookies.txt", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.ImportNetscape(strings.NewReader(cookiesTxt))).To(BeNil())
+
+		u, _ := url.Parse("https://example.org")
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(2))
+		sgot := toStrings(got)
+		Expect(sgot).To(ContainElement("cookie1_name=cookie1_value; Path=/; Domain=example.org"))
+		Expect(sgot).To(ContainElement("cookie2_name=cookie2_value; Path=/account; Expires=Fri, 01 Jan 2100 00:00:00 GMT; HttpOnly; Secure"))
+
+		u, _ = url.Parse("http://other.example.com")
+		got, err = j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].String()).To(Equal("cookie3_name=cookie3_value; Path=/"))
+	})
+
+	It("should export cookies.txt", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.ImportNetscape(strings.NewReader(cookiesTxt))).To(BeNil())
+
+		var buf bytes.Buffer
+		Expect(j.ExportNetscape(&buf)).To(BeNil())
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		Expect(lines[0]).To(Equal("# Netscape HTTP Cookie File"))
+		Expect(lines).To(ContainElement(".example.org\tTRUE\t/\tFALSE\t0\tcookie1_name\tcookie1_value"))
+		Expect(lines).To(ContainElement("#HttpOnly_example.org\tFALSE\t/account\tTRUE\t4102444800\tcookie2_name\tcookie2_value"))
+		Expect(lines).To(ContainElement("other.example.com\tFALSE\t/\tFALSE\t0\tcookie3_name\tcookie3_value"))
+	})
+
+	It("should stop importing and exporting when the context is done", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(j.ImportNetscapeContext(ctx, strings.NewReader(cookiesTxt))).To(Equal(context.Canceled))
+		var buf bytes.Buffer
+		Expect(j.ExportNetscapeContext(ctx, &buf)).To(Equal(context.Canceled))
+	})
+
+	It("should round trip cookies.txt", func() {
+		name1 := "test-db-" + randomName()
+		j1 := collysqlite.NewCookieJar(name1)
+		Expect(j1.Init()).To(BeNil())
+		defer j1.Destroy()
+		Expect(j1.ImportNetscape(strings.NewReader(cookiesTxt))).To(BeNil())
+		var buf1 bytes.Buffer
+		Expect(j1.ExportNetscape(&buf1)).To(BeNil())
+
+		name2 := "test-db-" + randomName()
+		j2 := collysqlite.NewCookieJar(name2)
+		Expect(j2.Init()).To(BeNil())
+		defer j2.Destroy()
+		Expect(j2.ImportNetscape(&buf1)).To(BeNil())
+		var buf2 bytes.Buffer
+		Expect(j2.ExportNetscape(&buf2)).To(BeNil())
+
+		var buf3 bytes.Buffer
+		Expect(j1.ExportNetscape(&buf3)).To(BeNil())
+		Expect(buf2.String()).To(Equal(buf3.String()))
+	})
+
+	It("should reject invalid lines", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		bad := []struct {
+			line string
+			msg  string
+		}{
+			{"example.org\tTRUE\t/\tFALSE\t0\tname", "line 2: expected 7 tab-separated fields, got 6"},
+			{"example.org\tYES\t/\tFALSE\t0\tname\tvalue", "line 2: invalid include-subdomains flag"},
+			{"example.org\tTRUE\t/\tNO\t0\tname\tvalue", "line 2: invalid secure flag"},
+			{"example.org\tTRUE\t/\tFALSE\tsoon\tname\tvalue", "line 2: invalid expiry \"soon\""},
+			{"example.org\tTRUE\t/\tFALSE\t300000000000\tname\tvalue", "line 2: invalid expiry \"300000000000\""},
+			{"example.org\tTRUE\t/\tFALSE\t0\t\tvalue", "line 2: empty cookie name"},
+			{"\tTRUE\t/\tFALSE\t0\tname\tvalue", "line 2: empty domain"},
+		}
+		for _, b := range bad {
+			err := j.ImportNetscape(strings.NewReader("# Netscape HTTP Cookie File\n" + b.line + "\n"))
+			Expect(err).NotTo(BeNil())
+			Expect(err.Error()).To(ContainSubstring(b.msg))
+		}
+	})
+})
@@ -0,0 +1,210 @@
+package collysqlite
+
+import (
+	"context"
+	"time"
+)
+
+// Profile returns a view of the jar holding the named profile's cookies,
+// allowing several independent cookie identities to share one database.
+// The default profile, used by the jar itself, has an empty name.
+//
+// A profile's jar takes its configuration from j: its Keys, Limits,
+// OnChange and Auditor are copied when the profile is first used, and
+// EnableCache and EnableAudit also apply to the profiles of j.
+func (j *CookieJar) Profile(name string) *CookieJar {
+	if name == j.ProfileName {
+		return j
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if p, ok := j.profiles[name]; ok {
+		return p
+	}
+	if j.profiles == nil {
+		j.profiles = make(map[string]*CookieJar)
+	}
+	s := &SQLiteCookieStore{
+		Path:        j.Path,
+		ProfileName: name,
+		Keys:        j.Keys,
+	}
+	p := &CookieJar{
+		SQLiteCookieStore: s,
+		CookieStoreJar:    NewCookieStoreJar(s),
+	}
+	p.Limits = j.Limits
+	p.OnChange = j.OnChange
+	p.Auditor = j.Auditor
+	if j.Auditor == j.SQLiteCookieStore {
+		p.Auditor = s
+	}
+	if j.cacheConfig != nil {
+		p.CookieStoreJar.EnableCache(*j.cacheConfig)
+	}
+	j.profiles[name] = p
+	return p
+}
+
+// EnableCache is like CookieStoreJar.EnableCache,
+// and also enables the cache of the jar's profiles.
+func (j *CookieJar) EnableCache(cfg CookieCacheConfig) {
+	j.CookieStoreJar.EnableCache(cfg)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cacheConfig = &cfg
+	for _, p := range j.profiles {
+		p.CookieStoreJar.EnableCache(cfg)
+	}
+}
+
+// Flush is like CookieStoreJar.Flush, and also flushes the jar's profiles.
+func (j *CookieJar) Flush() error {
+	return j.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but includes a context.
+func (j *CookieJar) FlushContext(ctx context.Context) error {
+	for _, p := range j.jars() {
+		err := p.CookieStoreJar.FlushContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is like CookieStoreJar.Close, and also closes the jar's profiles.
+func (j *CookieJar) Close() error {
+	return j.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but includes a context.
+func (j *CookieJar) CloseContext(ctx context.Context) error {
+	var first error
+	for _, p := range j.jars() {
+		err := p.CookieStoreJar.CloseContext(ctx)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Profile returns a view of the named profile's cookies, as CookieJar.Profile,
+// which handles errors as j does: OnError is called, and, if j has a
+// Fallback, the profile has its own MemoryCookieJar.
+func (j *ExplodingCookieJar) Profile(name string) *ExplodingCookieJar {
+	jar := j.Jar.Profile(name)
+	if jar == j.Jar {
+		return j
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if p, ok := j.profiles[name]; ok {
+		return p
+	}
+	if j.profiles == nil {
+		j.profiles = make(map[string]*ExplodingCookieJar)
+	}
+	p := &ExplodingCookieJar{
+		Jar:     jar,
+		OnError: j.OnError,
+	}
+	if j.Fallback != nil {
+		p.Fallback = NewMemoryCookieJar()
+	}
+	j.profiles[name] = p
+	return p
+}
+
+// jars returns j and the jars of any profiles it has used.
+func (j *CookieJar) jars() []*CookieJar {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	js := []*CookieJar{j}
+	for _, p := range j.profiles {
+		js = append(js, p)
+	}
+	return js
+}
+
+// Profiles returns the names of all profiles holding cookies, in sorted order.
+func (s *SQLiteCookieStore) Profiles() ([]string, error) {
+	return s.ProfilesContext(context.Background())
+}
+
+// ProfilesContext is like Profiles but includes a context.
+func (s *SQLiteCookieStore) ProfilesContext(ctx context.Context) ([]string, error) {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var names []string
+	err = db.SelectContext(ctx, &names, "SELECT DISTINCT profile FROM cookie_jar ORDER BY profile")
+	return names, err
+}
+
+// CloneProfile replaces the cookies of profile dst with a copy of those of profile src.
+func (s *SQLiteCookieStore) CloneProfile(src, dst string) error {
+	return s.CloneProfileContext(context.Background(), src, dst)
+}
+
+// CloneProfileContext is like CloneProfile but includes a context.
+func (s *SQLiteCookieStore) CloneProfileContext(ctx context.Context, src, dst string) error {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM cookie_jar WHERE profile = ?", dst)
+	if err != nil {
+		return err
+	}
+	var rs []cookieJarRecord
+	err = tx.SelectContext(ctx, &rs, "SELECT * FROM cookie_jar WHERE profile = ?", src)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, r := range rs {
+		// Encrypted cookies are bound to their profile, so are re-encrypted.
+		if s.Keys != nil {
+			cs, err := decryptText(s.Keys, r.Cookies, cookieAAD(src, r.Host))
+			if err != nil {
+				return err
+			}
+			r.Cookies, err = encryptText(s.Keys, cs, cookieAAD(dst, r.Host))
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.ExecContext(ctx, "INSERT INTO cookie_jar (profile, host, cookies, cookie_count, created_at) VALUES (?, ?, ?, ?, ?)", dst, r.Host, r.Cookies, r.Count, now)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// DeleteProfile removes all cookies of the named profile.
+func (s *SQLiteCookieStore) DeleteProfile(name string) error {
+	return s.DeleteProfileContext(context.Background(), name)
+}
+
+// DeleteProfileContext is like DeleteProfile but includes a context.
+func (s *SQLiteCookieStore) DeleteProfileContext(ctx context.Context, name string) error {
+	db, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM cookie_jar WHERE profile = ?", name)
+	return err
+}
@@ -0,0 +1,142 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieJar profiles", func() {
+
+	It("should keep profiles separate", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		url, _ := url.Parse("http://example.org")
+		alice := j.Profile("alice")
+		bob := j.Profile("bob")
+		Expect(j.Profile("alice")).To(BeIdenticalTo(alice))
+
+		Expect(alice.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "alice"},
+		})).To(BeNil())
+		Expect(bob.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "bob"},
+		})).To(BeNil())
+
+		got, err := alice.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Value).To(Equal("alice"))
+		got, err = bob.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Value).To(Equal("bob"))
+		// Default profile is untouched.
+		cs, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(cs).To(HaveLen(0))
+
+		names, err := j.Profiles()
+		Expect(err).To(BeNil())
+		Expect(names).To(Equal([]string{"alice", "bob"}))
+	})
+
+	It("should clone and delete profiles", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		url, _ := url.Parse("http://example.org")
+		Expect(j.Profile("alice").SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "alice"},
+		})).To(BeNil())
+		Expect(j.Profile("bob").SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "other", Value: "bob"},
+		})).To(BeNil())
+
+		// Clone replaces the destination.
+		Expect(j.CloneProfile("alice", "bob")).To(BeNil())
+		got, err := j.Profile("bob").Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(Equal([]string{"session=alice"}))
+
+		// Delete.
+		Expect(j.DeleteProfile("alice")).To(BeNil())
+		Expect(j.Profile("alice").Cookies(url)).To(HaveLen(0))
+		Expect(j.Profile("bob").Cookies(url)).To(HaveLen(1))
+		names, err := j.Profiles()
+		Expect(err).To(BeNil())
+		Expect(names).To(Equal([]string{"bob"}))
+	})
+
+	It("should inherit the jar's configuration", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.Limits.MaxCookieSize = 100
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		alice := j.Profile("alice")
+		j.EnableAudit()
+		j.EnableCache(collysqlite.CookieCacheConfig{FlushInterval: time.Hour})
+
+		url, _ := url.Parse("http://example.org")
+		Expect(alice.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "alice"},
+			&http.Cookie{Name: "large", Value: strings.Repeat("x", 100)},
+		})).To(BeNil())
+		Expect(j.Profile("bob").SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "bob"},
+		})).To(BeNil())
+		// Held by the write-behind cache.
+		other := collysqlite.NewCookieJar(name)
+		Expect(other.Profile("alice").Cookies(url)).To(HaveLen(0))
+		Expect(j.Close()).To(BeNil())
+		got, err := other.Profile("alice").Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(Equal([]string{"session=alice"}))
+		Expect(other.Profile("bob").Cookies(url)).To(HaveLen(1))
+
+		history, err := alice.CookieHistory("example.org")
+		Expect(err).To(BeNil())
+		Expect(history).To(HaveLen(1))
+	})
+
+	It("should handle profile errors as the ExplodingCookieJar does", func() {
+		name := "test-db-" + randomName()
+		var ops []string
+		j := &collysqlite.ExplodingCookieJar{
+			Jar: collysqlite.NewCookieJar(name),
+			OnError: func(op string, u *url.URL, err error) {
+				ops = append(ops, op)
+			},
+		}
+		alice := j.Profile("alice")
+		Expect(j.Profile("alice")).To(BeIdenticalTo(alice))
+		Expect(j.Profile("")).To(BeIdenticalTo(j))
+
+		// The database has not been initialised.
+		url, _ := url.Parse("http://example.org")
+		alice.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "alice"},
+		})
+		Expect(toStrings(alice.Cookies(url))).To(Equal([]string{"session=alice"}))
+		Expect(ops).To(Equal([]string{"SetCookies", "Cookies"}))
+		Expect(alice.LastError()).NotTo(BeNil())
+		Expect(j.LastError()).To(BeNil())
+
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		Expect(toStrings(alice.Cookies(url))).To(Equal([]string{"session=alice"}))
+		Expect(alice.LastError()).To(BeNil())
+	})
+})
@@ -1,7 +1,10 @@
 package collysqlite_test
 
 import (
+	"bytes"
+	"context"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"time"
 
@@ -168,6 +171,34 @@ var _ = Describe("CookieJar", func() {
 		Expect(got[0].String()).To(Equal("cookie2_name=cookie2_value; Path=/; Domain=example.org"))
 	})
 
+	It("should store cookies expiring after year 9999", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		url, _ := url.Parse("http://example.org")
+		far := time.Date(20000, 1, 1, 0, 0, 0, 0, time.UTC)
+		cookies := []*http.Cookie{
+			&http.Cookie{
+				Name:    "cookie1_name",
+				Value:   "cookie1_value",
+				Path:    "/",
+				Expires: far,
+			},
+		}
+		Expect(j.SetCookies(url, cookies)).To(BeNil())
+		Expect(cookies[0].Expires).To(Equal(far))
+		got, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+
+		// The expiry is clamped to the latest that can be stored.
+		var buf bytes.Buffer
+		Expect(j.ExportNetscape(&buf)).To(BeNil())
+		Expect(buf.String()).To(ContainSubstring("\t253402300799\tcookie1_name\t"))
+	})
+
 	It("should drop secure cookies if not over https", func() {
 		name := "test-db-" + randomName()
 		j := collysqlite.NewCookieJar(name)
@@ -204,6 +235,170 @@ var _ = Describe("CookieJar", func() {
 		Expect(got[0].String()).To(Equal("cookie2_name=cookie2_value; Path=/; Domain=example.org"))
 	})
 
+	It("should keep same-name cookies with different paths and domains", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		// SetCookies.
+		url, _ := url.Parse("http://www.example.org")
+		cookies := []*http.Cookie{
+			&http.Cookie{
+				Name:   "cookie_name",
+				Value:  "root_value",
+				Path:   "/",
+				Domain: ".example.org",
+			},
+			&http.Cookie{
+				Name:   "cookie_name",
+				Value:  "account_value",
+				Path:   "/account",
+				Domain: ".example.org",
+			},
+		}
+		Expect(j.SetCookies(url, cookies)).To(BeNil())
+		more := []*http.Cookie{
+			&http.Cookie{
+				Name:  "cookie_name",
+				Value: "host_only_value",
+				Path:  "/",
+			},
+		}
+		Expect(j.SetCookies(url, more)).To(BeNil())
+		got, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf(
+			"cookie_name=root_value; Path=/; Domain=example.org",
+			"cookie_name=account_value; Path=/account; Domain=example.org",
+			"cookie_name=host_only_value; Path=/",
+		))
+
+		// Update one of them, the domain is matched case-insensitively.
+		update := []*http.Cookie{
+			&http.Cookie{
+				Name:   "cookie_name",
+				Value:  "new_account_value",
+				Path:   "/account",
+				Domain: "EXAMPLE.org",
+			},
+		}
+		Expect(j.SetCookies(url, update)).To(BeNil())
+		got, err = j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf(
+			"cookie_name=root_value; Path=/; Domain=example.org",
+			"cookie_name=new_account_value; Path=/account; Domain=EXAMPLE.org",
+			"cookie_name=host_only_value; Path=/",
+		))
+	})
+
+	It("should identify cookies by their normalised domain and path", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		// A host-only cookie has the domain of the host that set it.
+		url, _ := url.Parse("http://example.org/")
+		Expect(j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "a", Value: "1"},
+		})).To(BeNil())
+		Expect(j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "a", Value: "2", Domain: "example.org"},
+		})).To(BeNil())
+		got, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf("a=2; Domain=example.org"))
+
+		// A cookie without a Path has the default path of the URL that set it.
+		Expect(j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "b", Value: "1", Path: "/"},
+		})).To(BeNil())
+		Expect(j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "b", MaxAge: -1},
+		})).To(BeNil())
+		got, err = j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf("a=2; Domain=example.org"))
+
+		// But not if the default path differs.
+		dir, _ := url.Parse("/dir/page")
+		Expect(j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "c", Value: "1", Path: "/"},
+		})).To(BeNil())
+		Expect(j.SetCookies(dir, []*http.Cookie{
+			&http.Cookie{Name: "c", MaxAge: -1},
+		})).To(BeNil())
+		got, err = j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf("a=2; Domain=example.org", "c=1; Path=/"))
+	})
+
+	It("should delete one of several same-name cookies", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		// SetCookies.
+		url, _ := url.Parse("http://example.org")
+		cookies := []*http.Cookie{
+			&http.Cookie{
+				Name:   "cookie_name",
+				Value:  "root_value",
+				Path:   "/",
+				Domain: ".example.org",
+			},
+			&http.Cookie{
+				Name:   "cookie_name",
+				Value:  "account_value",
+				Path:   "/account",
+				Domain: ".example.org",
+			},
+			&http.Cookie{
+				Name:   "cookie_name",
+				Value:  "admin_value",
+				Path:   "/admin",
+				Domain: ".example.org",
+			},
+		}
+		Expect(j.SetCookies(url, cookies)).To(BeNil())
+
+		// Delete by expiry.
+		expired := []*http.Cookie{
+			&http.Cookie{
+				Name:    "cookie_name",
+				Path:    "/account",
+				Domain:  ".example.org",
+				Expires: time.Now().Add(-time.Hour),
+			},
+		}
+		Expect(j.SetCookies(url, expired)).To(BeNil())
+		got, err := j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf(
+			"cookie_name=root_value; Path=/; Domain=example.org",
+			"cookie_name=admin_value; Path=/admin; Domain=example.org",
+		))
+
+		// Delete by Max-Age.
+		deleted := []*http.Cookie{
+			&http.Cookie{
+				Name:   "cookie_name",
+				Path:   "/admin",
+				Domain: ".example.org",
+				MaxAge: -1,
+			},
+		}
+		Expect(j.SetCookies(url, deleted)).To(BeNil())
+		got, err = j.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf(
+			"cookie_name=root_value; Path=/; Domain=example.org",
+		))
+	})
+
 	It("should not get cookies for an unknown domain", func() {
 		name := "test-db-" + randomName()
 		j := collysqlite.NewCookieJar(name)
@@ -244,8 +439,176 @@ var _ = Describe("CookieJar", func() {
 		Expect(got[0].String()).To(Equal(cookies[0].String()))
 	})
 
+	It("should honour a cancelled context", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.InitContext(context.Background())).To(BeNil())
+		defer j.Destroy()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		url, _ := url.Parse("http://example.org")
+		cookies := []*http.Cookie{
+			&http.Cookie{Name: "cookie1_name", Value: "cookie1_value"},
+		}
+		Expect(j.SetCookiesContext(ctx, url, cookies)).To(BeNil())
+		got, err := j.CookiesContext(ctx, url)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		cancel()
+		_, err = j.CookiesContext(ctx, url)
+		Expect(err).To(MatchError(context.Canceled))
+		Expect(j.SetCookiesContext(ctx, url, cookies)).To(MatchError(context.Canceled))
+	})
+
+})
+
+var _ = Describe("ExplodingCookieJar", func() {
+
+	It("should use OnError and Fallback when the database fails", func() {
+		name := "test-db-" + randomName()
+		fallback, _ := cookiejar.New(nil)
+		var ops []string
+		j := &collysqlite.ExplodingCookieJar{
+			Jar: collysqlite.NewCookieJar(name),
+			OnError: func(op string, u *url.URL, err error) {
+				ops = append(ops, op)
+			},
+			Fallback: fallback,
+		}
+		Expect(j.Init()).To(BeNil())
+		Expect(j.LastError()).To(BeNil())
+
+		url, _ := url.Parse("http://example.org")
+		cookies := []*http.Cookie{
+			&http.Cookie{
+				Name:  "cookie1_name",
+				Value: "cookie1_value",
+			},
+		}
+
+		// Break the database by dropping its table.
+		Expect(j.Destroy()).To(BeNil())
+		j.SetCookies(url, cookies)
+		got := j.Cookies(url)
+		Expect(ops).To(Equal([]string{"SetCookies", "Cookies"}))
+		Expect(j.LastError()).NotTo(BeNil())
+		// Served by the fallback.
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Name).To(Equal("cookie1_name"))
+
+		// Recover.
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		got = j.Cookies(url)
+		Expect(ops).To(HaveLen(2))
+		Expect(j.LastError()).To(BeNil())
+		// Cookies set on a custom Fallback are not written back.
+		Expect(got).To(HaveLen(0))
+	})
+
+	It("should write back cookies set on the default fallback on recovery", func() {
+		name := "test-db-" + randomName()
+		var ops []string
+		j := &collysqlite.ExplodingCookieJar{
+			Jar: collysqlite.NewCookieJar(name),
+			OnError: func(op string, u *url.URL, err error) {
+				ops = append(ops, op)
+			},
+		}
+		Expect(j.Init()).To(BeNil())
+		url, _ := url.Parse("http://example.org")
+		j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "1"},
+			&http.Cookie{Name: "other", Value: "1"},
+		})
+
+		// Refresh the session during an outage.
+		Expect(j.Destroy()).To(BeNil())
+		j.SetCookies(url, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: "2"},
+		})
+		got := j.Cookies(url)
+		Expect(toStrings(got)).To(Equal([]string{"session=2"}))
+		Expect(j.LastError()).NotTo(BeNil())
+
+		// Recover, the refreshed session is written back.
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		got = j.Cookies(url)
+		Expect(j.LastError()).To(BeNil())
+		Expect(toStrings(got)).To(Equal([]string{"session=2"}))
+		Expect(ops).To(Equal([]string{"SetCookies", "Cookies"}))
+		got, err := j.Jar.Cookies(url)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(Equal([]string{"session=2"}))
+	})
+
+	It("should not require a Fallback when OnError is set", func() {
+		name := "test-db-" + randomName()
+		var errs []error
+		j := &collysqlite.ExplodingCookieJar{
+			Jar: collysqlite.NewCookieJar(name),
+			OnError: func(op string, u *url.URL, err error) {
+				errs = append(errs, err)
+			},
+		}
+		Expect(j.Init()).To(BeNil())
+		Expect(j.Destroy()).To(BeNil())
+
+		url, _ := url.Parse("http://example.org")
+		Expect(j.Cookies(url)).To(BeNil())
+		Expect(errs).To(HaveLen(1))
+		Expect(j.LastError()).To(Equal(errs[0]))
+
+		// Clean up the file recreated by the failed call.
+		Expect(j.Init()).To(BeNil())
+		Expect(j.Destroy()).To(BeNil())
+	})
 })
 
+var _ = Describe("CollyCookieJarAdapter", func() {
+
+	It("should forward Init, Destroy and Close to the wrapped jar", func() {
+		inner, _ := cookiejar.New(nil)
+		jar := &lifecycleCookieJar{CookieJar: inner}
+		a := &collysqlite.CollyCookieJarAdapter{Jar: jar}
+		Expect(a.Init()).To(BeNil())
+		Expect(a.Destroy()).To(BeNil())
+		Expect(a.Close()).To(BeNil())
+		Expect(jar.calls).To(Equal([]string{"Init", "Destroy", "Close"}))
+	})
+
+	It("should ignore wrapped jars without Init, Destroy or Close", func() {
+		inner, _ := cookiejar.New(nil)
+		a := &collysqlite.CollyCookieJarAdapter{Jar: inner}
+		Expect(a.Init()).To(BeNil())
+		Expect(a.Destroy()).To(BeNil())
+		Expect(a.Close()).To(BeNil())
+	})
+})
+
+// lifecycleCookieJar is an http.CookieJar that records
+// calls to its Init, Destroy and Close methods.
+type lifecycleCookieJar struct {
+	http.CookieJar
+	calls []string
+}
+
+func (j *lifecycleCookieJar) Init() error {
+	j.calls = append(j.calls, "Init")
+	return nil
+}
+
+func (j *lifecycleCookieJar) Destroy() error {
+	j.calls = append(j.calls, "Destroy")
+	return nil
+}
+
+func (j *lifecycleCookieJar) Close() error {
+	j.calls = append(j.calls, "Close")
+	return nil
+}
+
 func toStrings(cookies []*http.Cookie) []string {
 	s := make([]string, len(cookies))
 	for i, c := range cookies {
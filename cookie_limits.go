@@ -0,0 +1,242 @@
+package collysqlite
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CookieLimits bounds the size and number of cookies held by a CookieStoreJar.
+// A zero value for any field means no limit.
+//
+// When a limit on the number of cookies is exceeded, the least recently
+// accessed cookies are evicted first, as browsers do. A cookie is accessed
+// when it is set, and when it is returned by Cookies or CookiesFor. Access
+// times are only stored while a limit on the number of cookies is set, and
+// reads update them at most once per cookieAccessInterval, to avoid
+// a database write on every read.
+type CookieLimits struct {
+	// MaxCookieSize is the maximum size in bytes of a cookie, measured as
+	// the length of its name, value and attributes. Larger cookies are ignored.
+	MaxCookieSize int
+	// MaxCookiesPerDomain is the maximum number of cookies held for a domain:
+	// those whose Domain attribute is the domain, and host-only cookies set
+	// by a host of that name.
+	MaxCookiesPerDomain int
+	// MaxCookies is the maximum number of cookies held in total.
+	MaxCookies int
+}
+
+// DefaultCookieLimits are the minimum limits recommended by RFC 6265.
+var DefaultCookieLimits = CookieLimits{
+	MaxCookieSize:       4096,
+	MaxCookiesPerDomain: 50,
+	MaxCookies:          3000,
+}
+
+// cookieAccessInterval is how stale a cookie's stored access time
+// may become before a read updates it.
+const cookieAccessInterval = time.Minute
+
+func cookieSize(c *http.Cookie) int {
+	return len(c.String())
+}
+
+// limitsCount reports whether l limits the number of cookies,
+// and so whether access times must be kept.
+func (l CookieLimits) limitsCount() bool {
+	return l.MaxCookiesPerDomain > 0 || l.MaxCookies > 0
+}
+
+// domainOf returns the domain that c, held for host, counts towards.
+func domainOf(host string, c storedCookie) string {
+	if c.Domain != "" {
+		return strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+	}
+	return siteOf(host)
+}
+
+func dropExpired(cookies []storedCookie, now time.Time) []storedCookie {
+	r := cookies[:0:0]
+	for _, c := range cookies {
+		if !isExpired(c.Cookie, now) {
+			r = append(r, c)
+		}
+	}
+	return r
+}
+
+// hostCookie is a cookie and the host it is held for.
+type hostCookie struct {
+	host string
+	c    storedCookie
+}
+
+// touch updates the access times of the named cookies held for host.
+// The caller must not hold j.mu.
+func (j *CookieStoreJar) touch(ctx context.Context, host string, keys map[cookieKey]bool, now time.Time) error {
+	j.mu.Lock()
+	up, err := j.update(ctx, func(up *cookieUpdate) error {
+		cookies, err := up.load(host)
+		if err != nil {
+			return err
+		}
+		touched := false
+		for i, c := range cookies {
+			if keys[keyOf(host, c)] && now.Sub(c.LastAccess) >= cookieAccessInterval {
+				cookies[i].LastAccess = now
+				touched = true
+			}
+		}
+		if !touched {
+			return nil
+		}
+		return up.save(host, cookies, nil)
+	})
+	j.mu.Unlock()
+	up.done()
+	return err
+}
+
+// limitPerDomain evicts the least recently accessed cookies beyond
+// MaxCookiesPerDomain, from each domain that the given cookies,
+// just set for host, count towards. A domain's cookies may be held
+// for the domain itself and any of its subdomains. source is the URL
+// that caused the change.
+// The caller must hold j.mu for writing.
+func (j *CookieStoreJar) limitPerDomain(up *cookieUpdate, host string, cookies []storedCookie, source string) error {
+	if j.Limits.MaxCookiesPerDomain <= 0 {
+		return nil
+	}
+	domains := make(map[string]bool)
+	for _, c := range cookies {
+		domains[domainOf(host, c)] = true
+	}
+	if len(domains) == 0 {
+		return nil
+	}
+	hosts, err := up.hosts()
+	if err != nil {
+		return err
+	}
+	for domain := range domains {
+		var held []string
+		for _, h := range hosts {
+			site := siteOf(h)
+			if site == domain || strings.HasSuffix(site, "."+domain) {
+				held = append(held, h)
+			}
+		}
+		err = j.evict(up, held, j.Limits.MaxCookiesPerDomain, func(h string, c storedCookie) bool {
+			return domainOf(h, c) == domain
+		}, source)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limitTotal evicts the least recently accessed cookies held by the jar
+// beyond MaxCookies. The cookies are counted by the store, if it can,
+// so that they need only be loaded when the limit is exceeded.
+// source is the URL that caused the change.
+// The caller must hold j.mu for writing.
+func (j *CookieStoreJar) limitTotal(up *cookieUpdate, source string) error {
+	if j.Limits.MaxCookies <= 0 {
+		return nil
+	}
+	n, ok, err := up.count()
+	if err != nil {
+		return err
+	}
+	if ok && n <= j.Limits.MaxCookies {
+		return nil
+	}
+	hosts, err := up.hosts()
+	if err != nil {
+		return err
+	}
+	return j.evict(up, hosts, j.Limits.MaxCookies, nil, source)
+}
+
+// evict evicts the least recently accessed of the cookies held for hosts
+// that match, or all of them if match is nil, beyond max.
+// The caller must hold j.mu for writing.
+func (j *CookieStoreJar) evict(up *cookieUpdate, hosts []string, max int, match func(host string, c storedCookie) bool, source string) error {
+	var all []hostCookie
+	byHost := make(map[string][]storedCookie)
+	for _, host := range hosts {
+		cookies, err := up.load(host)
+		if err != nil {
+			return err
+		}
+		byHost[host] = cookies
+		for _, c := range cookies {
+			if match == nil || match(host, c) {
+				all = append(all, hostCookie{host, c})
+			}
+		}
+	}
+	if len(all) <= max {
+		return nil
+	}
+
+	sort.SliceStable(all, func(a, b int) bool {
+		return all[a].c.LastAccess.Before(all[b].c.LastAccess)
+	})
+	evict := make(map[*http.Cookie]bool)
+	for _, hc := range all[:len(all)-max] {
+		evict[hc.c.Cookie] = true
+	}
+	now := time.Now()
+	for _, host := range hosts {
+		kept := byHost[host][:0:0]
+		for _, c := range byHost[host] {
+			if !evict[c.Cookie] {
+				kept = append(kept, c)
+			}
+		}
+		if len(kept) == len(byHost[host]) {
+			continue
+		}
+		err := up.save(host, kept, diffCookies(host, source, byHost[host], kept, now))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hosts returns the hosts that the jar holds cookies for, including those
+// only held by the cache's write-behind, in sorted order.
+// The caller must hold j.mu.
+func (j *CookieStoreJar) hosts(ctx context.Context) ([]string, error) {
+	hosts, err := storeHosts(ctx, j.Store)
+	if err != nil || j.cache == nil {
+		return hosts, err
+	}
+	seen := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		seen[h] = true
+	}
+	added := false
+	for _, h := range j.cache.unflushedHosts() {
+		if !seen[h] {
+			hosts = append(hosts, h)
+			added = true
+		}
+	}
+	if added {
+		sort.Strings(hosts)
+	}
+	return hosts, nil
+}
+
+// cookieCounter is implemented by CookieStores that can count
+// the cookies they hold without them being loaded.
+type cookieCounter interface {
+	CookieCountContext(ctx context.Context) (int, error)
+}
@@ -0,0 +1,170 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieLimits", func() {
+
+	var j *collysqlite.CookieJar
+
+	BeforeEach(func() {
+		j = collysqlite.NewCookieJar("test-db-" + randomName())
+		Expect(j.Init()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(j.Destroy()).To(BeNil())
+	})
+
+	set := func(host string, names ...string) {
+		u, _ := url.Parse("http://" + host)
+		for _, name := range names {
+			Expect(j.SetCookies(u, []*http.Cookie{
+				&http.Cookie{Name: name, Value: "1"},
+			})).To(BeNil())
+		}
+	}
+
+	get := func(host string) []string {
+		u, _ := url.Parse("http://" + host)
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		names := make([]string, len(got))
+		for i, c := range got {
+			names[i] = c.Name
+		}
+		return names
+	}
+
+	It("should default to the RFC 6265 minimums", func() {
+		Expect(collysqlite.DefaultCookieLimits).To(Equal(collysqlite.CookieLimits{
+			MaxCookieSize:       4096,
+			MaxCookiesPerDomain: 50,
+			MaxCookies:          3000,
+		}))
+	})
+
+	It("should be unlimited by default", func() {
+		for i := 0; i < 60; i++ {
+			set("example.org", "cookie"+strings.Repeat("x", i))
+		}
+		Expect(get("example.org")).To(HaveLen(60))
+	})
+
+	It("should ignore oversized cookies", func() {
+		j.Limits.MaxCookieSize = 100
+		u, _ := url.Parse("http://example.org")
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "small", Value: "1"},
+			&http.Cookie{Name: "large", Value: strings.Repeat("x", 100)},
+		})).To(BeNil())
+		Expect(get("example.org")).To(Equal([]string{"small"}))
+	})
+
+	It("should keep a stored cookie replaced by an oversized cookie", func() {
+		j.Limits.MaxCookieSize = 100
+		u, _ := url.Parse("http://example.org")
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "a", Value: "1"},
+		})).To(BeNil())
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "a", Value: strings.Repeat("x", 100)},
+		})).To(BeNil())
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Value).To(Equal("1"))
+	})
+
+	It("should evict the oldest cookies beyond the per domain limit", func() {
+		j.Limits.MaxCookiesPerDomain = 2
+		set("example.org", "a", "b", "c")
+		Expect(get("example.org")).To(ConsistOf("b", "c"))
+		// Setting a cookie again refreshes it.
+		set("example.org", "b", "d")
+		Expect(get("example.org")).To(ConsistOf("b", "d"))
+	})
+
+	It("should count a domain's cookies held for its subdomains", func() {
+		j.Limits.MaxCookiesPerDomain = 2
+		www, _ := url.Parse("http://www.example.org")
+		Expect(j.SetCookies(www, []*http.Cookie{
+			&http.Cookie{Name: "a", Value: "1", Domain: "example.org"},
+		})).To(BeNil())
+		Expect(j.SetCookies(www, []*http.Cookie{
+			&http.Cookie{Name: "host_only", Value: "1"},
+		})).To(BeNil())
+		set("example.org", "b", "c")
+		// The host-only cookie belongs to www.example.org.
+		Expect(get("www.example.org")).To(ConsistOf("host_only"))
+		Expect(get("example.org")).To(ConsistOf("b", "c"))
+	})
+
+	It("should refresh cookies when they are read", func() {
+		j.Limits.MaxCookiesPerDomain = 2
+		// Stored with access times long past.
+		Expect(j.SQLiteCookieStore.SetCookies("example.org",
+			`[{"name":"a","value":"1","lastAccess":"2000-01-01T00:00:00Z"},`+
+				`{"name":"b","value":"1","secure":true,"lastAccess":"2001-01-01T00:00:00Z"}]`)).To(BeNil())
+		// Only a is sent over http.
+		Expect(get("example.org")).To(ConsistOf("a"))
+		set("example.org", "c")
+		cs, err := j.SQLiteCookieStore.Cookies("example.org")
+		Expect(err).To(BeNil())
+		Expect(cs).To(ContainSubstring(`"name":"a"`))
+		Expect(cs).NotTo(ContainSubstring(`"name":"b"`))
+		Expect(cs).To(ContainSubstring(`"name":"c"`))
+	})
+
+	It("should only keep access times while the number of cookies is limited", func() {
+		set("example.org", "a")
+		cs, err := j.SQLiteCookieStore.Cookies("example.org")
+		Expect(err).To(BeNil())
+		Expect(cs).NotTo(ContainSubstring("lastAccess"))
+
+		j.Limits.MaxCookies = 10
+		set("example.org", "b")
+		cs, err = j.SQLiteCookieStore.Cookies("example.org")
+		Expect(err).To(BeNil())
+		Expect(cs).To(ContainSubstring("lastAccess"))
+	})
+
+	It("should count cookies in the database", func() {
+		set("example.org", "a", "b")
+		set("example.com", "c")
+		Expect(j.CookieCount()).To(Equal(3))
+		Expect(j.Profile("alice").CookieCount()).To(Equal(0))
+	})
+
+	It("should evict the oldest cookies beyond the total limit", func() {
+		j.Limits.MaxCookies = 3
+		set("example.org", "a", "b")
+		set("example.com", "c")
+		set("example.net", "d")
+		Expect(get("example.org")).To(ConsistOf("b"))
+		Expect(get("example.com")).To(ConsistOf("c"))
+		Expect(get("example.net")).To(ConsistOf("d"))
+		set("example.net", "e", "f")
+		Expect(get("example.org")).To(BeEmpty())
+		Expect(get("example.com")).To(BeEmpty())
+		Expect(get("example.net")).To(ConsistOf("d", "e", "f"))
+	})
+
+	It("should not expose access times to callers", func() {
+		j.Limits.MaxCookies = 10
+		set("example.org", "a")
+		u, _ := url.Parse("http://example.org")
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Unparsed).To(BeEmpty())
+	})
+})
@@ -0,0 +1,156 @@
+package collysqlite
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CookieRequest describes the request that cookies are being retrieved or
+// set for, so that CookiesFor and SetCookiesFor can apply the SameSite,
+// HttpOnly and Partitioned rules that a browser would.
+type CookieRequest struct {
+	// TopLevelSite is the site of the top-level document that the request
+	// is made from, e.g. "example.org". If set, a request to a host that is
+	// neither the site nor one of its subdomains is treated as cross-site.
+	// It is also the partition of Partitioned cookies: if it is not set,
+	// the request's own host is used.
+	TopLevelSite string
+	// CrossSite reports whether the request is cross-site,
+	// regardless of TopLevelSite.
+	CrossSite bool
+	// TopLevelNavigation reports whether the request navigates
+	// the top-level document, such as following a link.
+	TopLevelNavigation bool
+	// Method is the request's HTTP method. Empty means GET.
+	Method string
+	// NonHTTP reports whether the cookies are for a non-HTTP API,
+	// such as document.cookie, which cannot see HttpOnly cookies.
+	NonHTTP bool
+}
+
+// CookiesFor is like Cookies, but also filters the cookies according to the
+// given request, as a browser would. A nil request applies no extra rules,
+// other than that, as for Cookies, Partitioned cookies are only sent
+// within the partition of u's own site.
+func (j *CookieStoreJar) CookiesFor(u *url.URL, req *CookieRequest) ([]*http.Cookie, error) {
+	return j.CookiesForContext(context.Background(), u, req)
+}
+
+// CookiesForContext is like CookiesFor but includes a context.
+func (j *CookieStoreJar) CookiesForContext(ctx context.Context, u *url.URL, req *CookieRequest) ([]*http.Cookie, error) {
+	j.mu.RLock()
+	cookies, err := j.load(ctx, u.Host)
+	j.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if cookies == nil {
+		return nil, nil
+	}
+
+	// Filter.
+	now := time.Now()
+	site := topLevelSite(u, req)
+	var stale map[cookieKey]bool
+	cnew := make([]*http.Cookie, 0, len(cookies))
+	for _, c := range cookies {
+		// Drop expired cookies.
+		if isExpired(c.Cookie, now) {
+			continue
+		}
+		// Drop secure cookies if not over https.
+		if c.Secure && u.Scheme != "https" {
+			continue
+		}
+		// Drop cookies partitioned under another top-level site.
+		if c.Partitioned && !isSameSite(c.PartitionKey, site) {
+			continue
+		}
+		if req != nil && !req.allows(u, c.Cookie) {
+			continue
+		}
+		if j.Limits.limitsCount() && now.Sub(c.LastAccess) >= cookieAccessInterval {
+			if stale == nil {
+				stale = make(map[cookieKey]bool)
+			}
+			stale[keyOf(u.Host, c)] = true
+		}
+		cnew = append(cnew, c.Cookie)
+	}
+	if stale != nil {
+		err = j.touch(ctx, u.Host, stale, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cnew, nil
+}
+
+// allows reports whether cookie c may be sent with the request to u.
+func (r *CookieRequest) allows(u *url.URL, c *http.Cookie) bool {
+	if c.HttpOnly && r.NonHTTP {
+		return false
+	}
+	// Browsers reject these cookies outright.
+	if c.SameSite == http.SameSiteNoneMode && !c.Secure {
+		return false
+	}
+	if c.Partitioned && !c.Secure {
+		return false
+	}
+	if !r.isCrossSite(u) {
+		return true
+	}
+	switch c.SameSite {
+	case http.SameSiteStrictMode:
+		return false
+	case http.SameSiteNoneMode:
+		return true
+	}
+	// Lax, and unspecified which browsers treat as Lax.
+	return r.TopLevelNavigation && isSafeMethod(r.Method)
+}
+
+func (r *CookieRequest) isCrossSite(u *url.URL) bool {
+	if r.CrossSite {
+		return true
+	}
+	if r.TopLevelSite == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	site := siteOf(r.TopLevelSite)
+	return host != site && !strings.HasSuffix(host, "."+site)
+}
+
+// topLevelSite returns the site that a request to u is made from:
+// its TopLevelSite, if req has one, or else u's own host.
+func topLevelSite(u *url.URL, req *CookieRequest) string {
+	if req != nil && req.TopLevelSite != "" {
+		return siteOf(req.TopLevelSite)
+	}
+	return siteOf(u.Host)
+}
+
+// siteOf normalises a site or host, which may have a port, for comparison.
+func siteOf(host string) string {
+	u := url.URL{Host: host}
+	return strings.ToLower(strings.TrimPrefix(u.Hostname(), "."))
+}
+
+// isSameSite reports whether sites a and b are the same,
+// or one is a subdomain of the other.
+func isSameSite(a, b string) bool {
+	return a == b || strings.HasSuffix(a, "."+b) || strings.HasSuffix(b, "."+a)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
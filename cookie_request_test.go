@@ -0,0 +1,163 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieRequest", func() {
+
+	cookies := []*http.Cookie{
+		&http.Cookie{Name: "strict", Value: "1", Secure: true, SameSite: http.SameSiteStrictMode},
+		&http.Cookie{Name: "lax", Value: "1", Secure: true, SameSite: http.SameSiteLaxMode},
+		&http.Cookie{Name: "default", Value: "1", Secure: true},
+		&http.Cookie{Name: "none", Value: "1", Secure: true, SameSite: http.SameSiteNoneMode},
+		&http.Cookie{Name: "insecure_none", Value: "1", SameSite: http.SameSiteNoneMode},
+		&http.Cookie{Name: "http_only", Value: "1", HttpOnly: true},
+		&http.Cookie{Name: "partitioned", Value: "1", Secure: true, Partitioned: true, SameSite: http.SameSiteNoneMode},
+	}
+
+	names := func(cs []*http.Cookie) []string {
+		n := make([]string, len(cs))
+		for i, c := range cs {
+			n[i] = c.Name
+		}
+		return n
+	}
+
+	var j *collysqlite.CookieJar
+	u, _ := url.Parse("https://example.org")
+
+	BeforeEach(func() {
+		j = collysqlite.NewCookieJar("test-db-" + randomName())
+		Expect(j.Init()).To(BeNil())
+		Expect(j.SetCookies(u, cookies)).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(j.Destroy()).To(BeNil())
+	})
+
+	It("should preserve SameSite, HttpOnly and Partitioned", func() {
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(ConsistOf(
+			"strict=1; Secure; SameSite=Strict",
+			"lax=1; Secure; SameSite=Lax",
+			"default=1; Secure",
+			"none=1; Secure; SameSite=None",
+			"insecure_none=1; SameSite=None",
+			"http_only=1; HttpOnly",
+			"partitioned=1; Secure; SameSite=None; Partitioned",
+		))
+	})
+
+	It("should send all valid cookies on same-site requests", func() {
+		got, err := j.CookiesFor(u, &collysqlite.CookieRequest{TopLevelSite: "example.org"})
+		Expect(err).To(BeNil())
+		Expect(names(got)).To(ConsistOf("strict", "lax", "default", "none", "http_only", "partitioned"))
+
+		sub, _ := url.Parse("https://www.example.org")
+		Expect(j.SetCookies(sub, cookies[:1])).To(BeNil())
+		got, err = j.CookiesFor(sub, &collysqlite.CookieRequest{TopLevelSite: "example.org"})
+		Expect(err).To(BeNil())
+		Expect(names(got)).To(ConsistOf("strict"))
+	})
+
+	It("should apply SameSite rules to cross-site subresource requests", func() {
+		// The partitioned cookie was set under example.org's partition.
+		got, err := j.CookiesFor(u, &collysqlite.CookieRequest{TopLevelSite: "example.com"})
+		Expect(err).To(BeNil())
+		Expect(names(got)).To(ConsistOf("none"))
+	})
+
+	It("should only send partitioned cookies within their partition", func() {
+		fromCom := &collysqlite.CookieRequest{TopLevelSite: "example.com"}
+		fromNet := &collysqlite.CookieRequest{TopLevelSite: "www.example.net"}
+		Expect(j.SetCookiesFor(u, []*http.Cookie{
+			&http.Cookie{Name: "partitioned", Value: "com", Secure: true, Partitioned: true, SameSite: http.SameSiteNoneMode},
+		}, fromCom)).To(BeNil())
+		Expect(j.SetCookiesFor(u, []*http.Cookie{
+			&http.Cookie{Name: "partitioned", Value: "net", Secure: true, Partitioned: true, SameSite: http.SameSiteNoneMode},
+		}, fromNet)).To(BeNil())
+
+		values := func(req *collysqlite.CookieRequest) []string {
+			got, err := j.CookiesFor(u, req)
+			Expect(err).To(BeNil())
+			var vs []string
+			for _, c := range got {
+				if c.Name == "partitioned" {
+					vs = append(vs, c.Value)
+				}
+			}
+			return vs
+		}
+		Expect(values(nil)).To(Equal([]string{"1"}))
+		Expect(values(&collysqlite.CookieRequest{TopLevelSite: "example.org"})).To(Equal([]string{"1"}))
+		Expect(values(fromCom)).To(Equal([]string{"com"}))
+		Expect(values(&collysqlite.CookieRequest{TopLevelSite: "example.net"})).To(Equal([]string{"net"}))
+		Expect(values(&collysqlite.CookieRequest{TopLevelSite: "example.edu"})).To(BeEmpty())
+	})
+
+	It("should store every field of a cookie exactly", func() {
+		expires := time.Date(2100, 1, 2, 3, 4, 5, 6, time.UTC)
+		want := []*http.Cookie{
+			&http.Cookie{Name: "lax", Value: "1", Path: "/a", SameSite: http.SameSiteLaxMode},
+			&http.Cookie{Name: "strict", Value: "1", Domain: "example.org", SameSite: http.SameSiteStrictMode},
+			&http.Cookie{Name: "none", Value: "1", Secure: true, SameSite: http.SameSiteNoneMode, Expires: expires},
+			&http.Cookie{Name: "default", Value: "1", SameSite: http.SameSiteDefaultMode},
+			&http.Cookie{Name: "unset", Value: "a b", Quoted: true, MaxAge: 60},
+			&http.Cookie{Name: "http_only", Value: "1", HttpOnly: true, Unparsed: []string{"Priority=High"}},
+			&http.Cookie{Name: "partitioned", Value: "1", Secure: true, Partitioned: true},
+		}
+		other := collysqlite.NewCookieJar("test-db-" + randomName())
+		Expect(other.Init()).To(BeNil())
+		defer other.Destroy()
+		Expect(other.SetCookies(u, want)).To(BeNil())
+		got, err := other.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(len(want)))
+		for i, c := range got {
+			Expect(c.Expires.Equal(want[i].Expires)).To(BeTrue())
+			c.Expires = want[i].Expires
+			Expect(c).To(Equal(want[i]))
+		}
+	})
+
+	It("should read cookies stored as Set-Cookie lines", func() {
+		s := collysqlite.NewMemoryCookieStore()
+		Expect(s.SetCookies("example.org", "a=1; Path=/; SameSite=Lax\nb=2; Secure; HttpOnly; Partitioned")).To(BeNil())
+		jar := collysqlite.NewCookieStoreJar(s)
+		got, err := jar.CookiesFor(u, nil)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(Equal([]string{
+			"a=1; Path=/; SameSite=Lax",
+			"b=2; HttpOnly; Secure; Partitioned",
+		}))
+		got, err = jar.CookiesFor(u, &collysqlite.CookieRequest{TopLevelSite: "example.com"})
+		Expect(err).To(BeNil())
+		Expect(got).To(BeEmpty())
+	})
+
+	It("should apply SameSite rules to cross-site top-level navigations", func() {
+		got, err := j.CookiesFor(u, &collysqlite.CookieRequest{CrossSite: true, TopLevelNavigation: true})
+		Expect(err).To(BeNil())
+		Expect(names(got)).To(ConsistOf("lax", "default", "none", "http_only", "partitioned"))
+
+		got, err = j.CookiesFor(u, &collysqlite.CookieRequest{CrossSite: true, TopLevelNavigation: true, Method: http.MethodPost})
+		Expect(err).To(BeNil())
+		Expect(names(got)).To(ConsistOf("none", "partitioned"))
+	})
+
+	It("should hide HttpOnly cookies from non-HTTP APIs", func() {
+		got, err := j.CookiesFor(u, &collysqlite.CookieRequest{NonHTTP: true})
+		Expect(err).To(BeNil())
+		Expect(names(got)).NotTo(ContainElement("http_only"))
+	})
+})
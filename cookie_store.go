@@ -0,0 +1,165 @@
+package collysqlite
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// CookieStore persists serialised cookies by host.
+// Implementations need not know anything about cookies themselves:
+// all parsing, merging and filtering is done by CookieStoreJar.
+type CookieStore interface {
+	Init() error
+	Destroy() error
+	// Cookies returns the serialised cookies for the given host,
+	// or an empty string if there are none.
+	Cookies(host string) (string, error)
+	// SetCookies replaces the serialised cookies for the given host.
+	SetCookies(host string, cs string) error
+	// Hosts returns all hosts that have cookies, in sorted order.
+	Hosts() ([]string, error)
+}
+
+// ContextCookieStore is a CookieStore whose methods can also take a context.
+type ContextCookieStore interface {
+	CookieStore
+	InitContext(ctx context.Context) error
+	DestroyContext(ctx context.Context) error
+	CookiesContext(ctx context.Context, host string) (string, error)
+	SetCookiesContext(ctx context.Context, host string, cs string) error
+	HostsContext(ctx context.Context) ([]string, error)
+}
+
+// TxCookieStore is a CookieStore that can make several changes atomically,
+// such as in a database transaction.
+type TxCookieStore interface {
+	CookieStore
+	// UpdateCookies calls fn with a transaction on the store, committing
+	// it if fn returns nil, and otherwise rolling it back.
+	UpdateCookies(fn func(tx CookieTx) error) error
+	// UpdateCookiesContext is like UpdateCookies but includes a context.
+	UpdateCookiesContext(ctx context.Context, fn func(tx CookieTx) error) error
+}
+
+// CookieTx is a transaction on a TxCookieStore. If it is also a
+// CookieAuditor, changes it records are committed with the cookies.
+type CookieTx interface {
+	Cookies(host string) (string, error)
+	SetCookies(host string, cs string) error
+	Hosts() ([]string, error)
+}
+
+// The following helpers call the context-aware methods of a store if it is
+// a ContextCookieStore, otherwise they check ctx then call the plain methods.
+
+func storeInit(ctx context.Context, s CookieStore) error {
+	if cs, ok := s.(ContextCookieStore); ok {
+		return cs.InitContext(ctx)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return s.Init()
+}
+
+func storeDestroy(ctx context.Context, s CookieStore) error {
+	if cs, ok := s.(ContextCookieStore); ok {
+		return cs.DestroyContext(ctx)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return s.Destroy()
+}
+
+func storeCookies(ctx context.Context, s CookieStore, host string) (string, error) {
+	if cs, ok := s.(ContextCookieStore); ok {
+		return cs.CookiesContext(ctx, host)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return "", err
+	}
+	return s.Cookies(host)
+}
+
+func storeSetCookies(ctx context.Context, s CookieStore, host string, cookies string) error {
+	if cs, ok := s.(ContextCookieStore); ok {
+		return cs.SetCookiesContext(ctx, host, cookies)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return s.SetCookies(host, cookies)
+}
+
+func storeHosts(ctx context.Context, s CookieStore) ([]string, error) {
+	if cs, ok := s.(ContextCookieStore); ok {
+		return cs.HostsContext(ctx)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	return s.Hosts()
+}
+
+var _ CookieStore = &MemoryCookieStore{}
+
+// MemoryCookieStore is a CookieStore held in memory,
+// it is primarily useful for testing.
+type MemoryCookieStore struct {
+	mu      sync.RWMutex
+	cookies map[string]string
+}
+
+func NewMemoryCookieStore() *MemoryCookieStore {
+	return &MemoryCookieStore{}
+}
+
+func (s *MemoryCookieStore) Init() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookies == nil {
+		s.cookies = make(map[string]string)
+	}
+	return nil
+}
+
+func (s *MemoryCookieStore) Destroy() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cookies = nil
+	return nil
+}
+
+func (s *MemoryCookieStore) Cookies(host string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cookies[host], nil
+}
+
+func (s *MemoryCookieStore) SetCookies(host string, cs string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cookies == nil {
+		s.cookies = make(map[string]string)
+	}
+	s.cookies[host] = cs
+	return nil
+}
+
+func (s *MemoryCookieStore) Hosts() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	hosts := make([]string, 0, len(s.cookies))
+	for host := range s.cookies {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts, nil
+}
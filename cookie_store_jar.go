@@ -0,0 +1,734 @@
+package collysqlite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ CollyPersistentCookieJar = &CookieStoreJar{}
+
+// CookieStoreJar is a CollyPersistentCookieJar over a CookieStore.
+// It handles all cookie serialisation, merging and filtering in memory,
+// so that the underlying store need only persist a string per host.
+type CookieStoreJar struct {
+	Store CookieStore
+	// Limits, if set, bounds the size and number of cookies held.
+	Limits CookieLimits
+	// OnChange, if set, is called with each change made to the jar's cookies,
+	// once the change is made and the jar is unlocked, so that it may
+	// use the jar.
+	OnChange func(CookieChange)
+	// Auditor, if set, records each change made to the jar's cookies.
+	// If it is the Store itself, a TxCookieStore whose transactions are
+	// CookieAuditors, changes are recorded in the transaction that makes
+	// them. Otherwise they are recorded once the cookies are written,
+	// and errors recording them are ignored rather than failing the write.
+	// With write-behind, changes are recorded when the cookies are flushed.
+	Auditor CookieAuditor
+
+	mu    sync.RWMutex
+	cache *cookieCache
+}
+
+func NewCookieStoreJar(store CookieStore) *CookieStoreJar {
+	j := &CookieStoreJar{
+		Store: store,
+	}
+	return j
+}
+
+func (j *CookieStoreJar) Init() error {
+	return j.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (j *CookieStoreJar) InitContext(ctx context.Context) error {
+	return storeInit(ctx, j.Store)
+}
+
+func (j *CookieStoreJar) Destroy() error {
+	return j.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (j *CookieStoreJar) DestroyContext(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cache != nil {
+		j.cache.reset()
+	}
+	return storeDestroy(ctx, j.Store)
+}
+
+// Close flushes any cached writes, then calls Close on the Store if it is a Closer.
+func (j *CookieStoreJar) Close() error {
+	return j.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but includes a context.
+func (j *CookieStoreJar) CloseContext(ctx context.Context) error {
+	j.mu.Lock()
+	unaudited, err := j.flush(ctx)
+	j.mu.Unlock()
+	j.audit(ctx, unaudited)
+	if err != nil {
+		return err
+	}
+	return closeIfCloser(ctx, j.Store)
+}
+
+// reset discards any cached cookies, including unflushed writes,
+// such as when the store has been replaced.
+func (j *CookieStoreJar) reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.cache != nil {
+		j.cache.reset()
+	}
+}
+
+func (j *CookieStoreJar) Cookies(u *url.URL) ([]*http.Cookie, error) {
+	return j.CookiesForContext(context.Background(), u, nil)
+}
+
+// CookiesContext is like Cookies but includes a context.
+func (j *CookieStoreJar) CookiesContext(ctx context.Context, u *url.URL) ([]*http.Cookie, error) {
+	return j.CookiesForContext(ctx, u, nil)
+}
+
+func (j *CookieStoreJar) SetCookies(u *url.URL, cookies []*http.Cookie) error {
+	return j.SetCookiesContext(context.Background(), u, cookies)
+}
+
+// SetCookiesContext is like SetCookies but includes a context.
+func (j *CookieStoreJar) SetCookiesContext(ctx context.Context, u *url.URL, cookies []*http.Cookie) error {
+	return j.SetCookiesForContext(ctx, u, cookies, nil)
+}
+
+// SetCookiesFor is like SetCookies, but for cookies set in response to the
+// given request. Partitioned cookies are kept in the partition of the
+// request's TopLevelSite, or of u's host if it is not set, and are only
+// sent by CookiesFor to requests from that site. A nil request is treated
+// as a request from u's own site.
+func (j *CookieStoreJar) SetCookiesFor(u *url.URL, cookies []*http.Cookie, req *CookieRequest) error {
+	return j.SetCookiesForContext(context.Background(), u, cookies, req)
+}
+
+// SetCookiesForContext is like SetCookiesFor but includes a context.
+func (j *CookieStoreJar) SetCookiesForContext(ctx context.Context, u *url.URL, cookies []*http.Cookie, req *CookieRequest) error {
+	// We need to use a write lock to prevent a race in the db:
+	// if two callers set cookies in a very small window of time,
+	// it is possible to drop the new cookies from one caller
+	// ('last update wins' == best avoided).
+	j.mu.Lock()
+	up, err := j.update(ctx, func(up *cookieUpdate) error {
+		existing, err := up.load(u.Host)
+		if err != nil {
+			return err
+		}
+
+		// Merge existing cookies, new cookies have precendence.
+		// Cookies are identified by name, domain and path, as per RFC 6265,
+		// and by partition, and a later cookie replaces an earlier one with
+		// the same identity.
+		now := time.Now()
+		site := topLevelSite(u, req)
+		seen := make(map[cookieKey]bool)
+		cnew := make([]storedCookie, 0, len(cookies)+len(existing))
+		for i := len(cookies) - 1; i >= 0; i-- {
+			c := storedCookie{Cookie: cookies[i]}
+			if c.Partitioned {
+				c.PartitionKey = site
+			}
+			c.Cookie = clampExpiry(c.Cookie)
+			if c.Path == "" {
+				c.DefaultPath = defaultPath(u)
+			}
+			// Oversized cookies are ignored, leaving any stored
+			// cookie of the same identity in place.
+			if j.Limits.MaxCookieSize > 0 && cookieSize(c.Cookie) > j.Limits.MaxCookieSize {
+				continue
+			}
+			if seen[keyOf(u.Host, c)] {
+				continue
+			}
+			seen[keyOf(u.Host, c)] = true
+			if j.Limits.limitsCount() {
+				c.LastAccess = now
+			}
+			cnew = append(cnew, c)
+		}
+		reverse(cnew)
+		set := cnew
+		for _, c := range existing {
+			if !seen[keyOf(u.Host, c)] {
+				cnew = append(cnew, c)
+			}
+		}
+		cnew = dropExpired(cnew, now)
+		err = up.save(u.Host, cnew, diffCookies(u.Host, u.String(), existing, cnew, now))
+		if err != nil {
+			return err
+		}
+		err = j.limitPerDomain(up, u.Host, set, u.String())
+		if err != nil {
+			return err
+		}
+		return j.limitTotal(up, u.String())
+	})
+	j.mu.Unlock()
+	up.done()
+	return err
+}
+
+// load returns the stored cookies for host, or nil if there are none.
+// The caller must hold j.mu.
+func (j *CookieStoreJar) load(ctx context.Context, host string) ([]storedCookie, error) {
+	if j.cache != nil {
+		return j.cache.load(ctx, j.Store, host)
+	}
+	cs, err := storeCookies(ctx, j.Store, host)
+	if err != nil || cs == "" {
+		return nil, err
+	}
+	return unstringify(cs, host)
+}
+
+// cookieUpdate is a change to the cookies of a CookieStoreJar. If its
+// store is a TxCookieStore, and write-behind is not enabled, the change
+// is made in a transaction, together with the recording of its changes
+// if the Auditor is the store itself.
+type cookieUpdate struct {
+	j   *CookieStoreJar
+	ctx context.Context
+	// tx is the transaction that the change is made in, if any.
+	tx CookieTx
+	// saved are the entries written in tx, to be cached once committed.
+	saved map[string]*cookieCacheEntry
+	// changes are the changes made, to be passed to OnChange.
+	changes []CookieChange
+	// unaudited are the changes that the Auditor is yet to record.
+	unaudited []CookieChange
+}
+
+// update calls fn with a cookieUpdate, committing the changes that it
+// makes if it returns nil. The caller must hold j.mu for writing, and
+// call done on the returned cookieUpdate once it has released j.mu.
+func (j *CookieStoreJar) update(ctx context.Context, fn func(up *cookieUpdate) error) (*cookieUpdate, error) {
+	up := &cookieUpdate{j: j, ctx: ctx}
+	ts, ok := j.Store.(TxCookieStore)
+	if !ok || j.writeBehind() {
+		// Without a transaction, each write takes effect as it is made.
+		err := fn(up)
+		return up, err
+	}
+	err := ts.UpdateCookiesContext(ctx, func(tx CookieTx) error {
+		up.tx = tx
+		up.saved = make(map[string]*cookieCacheEntry)
+		up.changes = nil
+		up.unaudited = nil
+		return fn(up)
+	})
+	if err != nil {
+		up.changes = nil
+		up.unaudited = nil
+		return up, err
+	}
+	if j.cache != nil {
+		for host, e := range up.saved {
+			j.cache.put(host, e)
+		}
+	}
+	return up, nil
+}
+
+// load returns the cookies held for host, including any written by up.
+// In a transaction they are read in it, so that they cannot be changed,
+// such as by another process, before they are written back. Cached
+// cookies are only used if the store's version shows them to be current.
+func (up *cookieUpdate) load(host string) ([]storedCookie, error) {
+	if e, ok := up.saved[host]; ok {
+		return copyCookies(e.cookies), nil
+	}
+	if up.tx == nil {
+		return up.j.load(up.ctx, host)
+	}
+	vt, ok := up.tx.(interface {
+		Version(host string) (int64, error)
+	})
+	if ok && up.j.cache != nil {
+		v, err := vt.Version(host)
+		if err != nil {
+			return nil, err
+		}
+		cookies, ok := up.j.cache.current(host, v)
+		if ok {
+			return cookies, nil
+		}
+	}
+	cs, err := up.tx.Cookies(host)
+	if err != nil || cs == "" {
+		return nil, err
+	}
+	return unstringify(cs, host)
+}
+
+// save replaces the cookies held for host, making the given changes.
+func (up *cookieUpdate) save(host string, cookies []storedCookie, changes []CookieChange) error {
+	j := up.j
+	cs, err := stringify(cookies)
+	if err != nil {
+		return err
+	}
+	switch {
+	case up.tx != nil:
+		err := up.tx.SetCookies(host, cs)
+		if err != nil {
+			return err
+		}
+		if a, ok := up.tx.(CookieAuditor); ok && j.auditsInTx() && len(changes) > 0 {
+			err = a.RecordCookieChanges(changes)
+			if err != nil {
+				return err
+			}
+		} else {
+			up.unaudited = append(up.unaudited, changes...)
+		}
+		e, err := newCookieCacheEntry(host, cs)
+		if err != nil {
+			return err
+		}
+		if vt, ok := up.tx.(interface {
+			Version(host string) (int64, error)
+		}); ok {
+			e.version, err = vt.Version(host)
+			if err != nil {
+				return err
+			}
+			e.versioned = true
+			e.checked = time.Now()
+		}
+		up.saved[host] = e
+	case j.writeBehind():
+		// Changes are recorded when the cookies are flushed.
+		err := j.cache.save(up.ctx, j.Store, host, cs, changes)
+		if err != nil {
+			return err
+		}
+	case j.cache != nil:
+		err := j.cache.save(up.ctx, j.Store, host, cs, nil)
+		if err != nil {
+			return err
+		}
+		up.unaudited = append(up.unaudited, changes...)
+	default:
+		err := storeSetCookies(up.ctx, j.Store, host, cs)
+		if err != nil {
+			return err
+		}
+		up.unaudited = append(up.unaudited, changes...)
+	}
+	up.changes = append(up.changes, changes...)
+	return nil
+}
+
+// hosts returns the hosts that cookies are held for, in sorted order.
+func (up *cookieUpdate) hosts() ([]string, error) {
+	if up.tx != nil {
+		return up.tx.Hosts()
+	}
+	return up.j.hosts(up.ctx)
+}
+
+// count returns the number of cookies held, if the store can count them.
+func (up *cookieUpdate) count() (int, bool, error) {
+	if up.tx != nil {
+		ct, ok := up.tx.(interface {
+			CookieCount() (int, error)
+		})
+		if !ok {
+			return 0, false, nil
+		}
+		n, err := ct.CookieCount()
+		return n, true, err
+	}
+	cs, ok := up.j.Store.(cookieCounter)
+	if !ok {
+		return 0, false, nil
+	}
+	n, err := cs.CookieCountContext(up.ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	if up.j.cache != nil {
+		n += up.j.cache.unflushedCount()
+	}
+	return n, true, nil
+}
+
+// done records any unaudited changes with the Auditor, unless this was
+// done in the transaction or is left to write-behind, and passes all
+// changes to OnChange. The caller must not hold j.mu.
+func (up *cookieUpdate) done() {
+	up.j.audit(up.ctx, up.unaudited)
+	if up.j.OnChange != nil {
+		for _, c := range up.changes {
+			up.j.OnChange(c)
+		}
+	}
+}
+
+// writeBehind reports whether the cache holds writes until flushed.
+func (j *CookieStoreJar) writeBehind() bool {
+	return j.cache != nil && j.cache.cfg.FlushInterval > 0
+}
+
+// writeFlushed writes host's cookies held by write-behind to the store,
+// recording the changes they make in the transaction if it can, and
+// otherwise returning them to be recorded once j.mu is released.
+func (j *CookieStoreJar) writeFlushed(ctx context.Context, host string, cs string, changes []CookieChange) ([]CookieChange, error) {
+	ts, ok := j.Store.(TxCookieStore)
+	if !ok {
+		err := storeSetCookies(ctx, j.Store, host, cs)
+		if err != nil {
+			return nil, err
+		}
+		return changes, nil
+	}
+	audited := false
+	err := ts.UpdateCookiesContext(ctx, func(tx CookieTx) error {
+		err := tx.SetCookies(host, cs)
+		if err != nil {
+			return err
+		}
+		a, ok := tx.(CookieAuditor)
+		if !ok || !j.auditsInTx() || len(changes) == 0 {
+			return nil
+		}
+		audited = true
+		return a.RecordCookieChanges(changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if audited {
+		return nil, nil
+	}
+	return changes, nil
+}
+
+// importCookies stores each cookie against its corresponding host,
+// grouping them so that each host is written once.
+func (j *CookieStoreJar) importCookies(ctx context.Context, hosts []string, cookies []*http.Cookie) error {
+	var order []string
+	byHost := make(map[string][]*http.Cookie)
+	for i, host := range hosts {
+		if _, ok := byHost[host]; !ok {
+			order = append(order, host)
+		}
+		byHost[host] = append(byHost[host], cookies[i])
+	}
+	for _, host := range order {
+		u := &url.URL{Scheme: "http", Host: host}
+		err := j.SetCookiesContext(ctx, u, byHost[host])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCookies calls fn with each unexpired cookie held in the jar,
+// and the host it is stored against, ordered by host.
+func (j *CookieStoreJar) exportCookies(ctx context.Context, fn func(host string, c *http.Cookie)) error {
+	err := j.FlushContext(ctx)
+	if err != nil {
+		return err
+	}
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	hosts, err := storeHosts(ctx, j.Store)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, host := range hosts {
+		cookies, err := j.load(ctx, host)
+		if err != nil {
+			return err
+		}
+		for _, c := range cookies {
+			if isExpired(c.Cookie, now) {
+				continue
+			}
+			fn(host, c.Cookie)
+		}
+	}
+	return nil
+}
+
+// isExpired reports whether c has expired, or is a deletion (Max-Age <= 0).
+func isExpired(c *http.Cookie, now time.Time) bool {
+	return c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now))
+}
+
+// cookieKey is the identity of a cookie, as per RFC 6265,
+// with its partition as per CHIPS.
+type cookieKey struct {
+	name      string
+	domain    string
+	path      string
+	partition string
+}
+
+// keyOf returns the identity of c, held for host. A host-only cookie's
+// domain is host, and a cookie without a Path has its default path.
+func keyOf(host string, c storedCookie) cookieKey {
+	path := c.Path
+	if path == "" {
+		path = c.DefaultPath
+	}
+	if path == "" {
+		path = "/"
+	}
+	return cookieKey{
+		name:      c.Name,
+		domain:    domainOf(host, c),
+		path:      path,
+		partition: c.PartitionKey,
+	}
+}
+
+// defaultPath returns the default-path of cookies set in response
+// to u, as per RFC 6265 section 5.1.4.
+func defaultPath(u *url.URL) string {
+	p := u.Path
+	if !strings.HasPrefix(p, "/") {
+		return "/"
+	}
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
+
+func reverse(cookies []storedCookie) {
+	for i, j := 0, len(cookies)-1; i < j; i, j = i+1, j-1 {
+		cookies[i], cookies[j] = cookies[j], cookies[i]
+	}
+}
+
+// storedCookie is a cookie as held by a CookieStoreJar,
+// with the state that is stored alongside it.
+type storedCookie struct {
+	*http.Cookie
+	// PartitionKey is the top-level site that a Partitioned cookie
+	// was set from, and the only site that it is sent to requests from.
+	PartitionKey string
+	// DefaultPath is the default path of a cookie set without a Path,
+	// which is part of its identity, see keyOf.
+	DefaultPath string
+	// LastAccess is when the cookie was last set or read, if access
+	// times are being kept, see CookieLimits.
+	LastAccess time.Time
+}
+
+// copyCookies returns copies of cookies that may be modified
+// without affecting the originals.
+func copyCookies(cookies []storedCookie) []storedCookie {
+	r := make([]storedCookie, len(cookies))
+	for i, c := range cookies {
+		cc := *c.Cookie
+		r[i] = c
+		r[i].Cookie = &cc
+	}
+	return r
+}
+
+// cookieRecord is the stored form of a cookie. Unlike a Set-Cookie
+// header, it keeps every field of the cookie as it was set.
+type cookieRecord struct {
+	Name         string     `json:"name"`
+	Value        string     `json:"value"`
+	Quoted       bool       `json:"quoted,omitempty"`
+	Path         string     `json:"path,omitempty"`
+	Domain       string     `json:"domain,omitempty"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxAge       int        `json:"maxAge,omitempty"`
+	Secure       bool       `json:"secure,omitempty"`
+	HttpOnly     bool       `json:"httpOnly,omitempty"`
+	SameSite     string     `json:"sameSite,omitempty"`
+	Partitioned  bool       `json:"partitioned,omitempty"`
+	PartitionKey string     `json:"partitionKey,omitempty"`
+	DefaultPath  string     `json:"defaultPath,omitempty"`
+	Unparsed     []string   `json:"unparsed,omitempty"`
+	LastAccess   *time.Time `json:"lastAccess,omitempty"`
+}
+
+// sameSiteNames are the stored forms of the SameSite modes.
+// SameSite's zero value, meaning no mode was given, is stored as empty.
+var sameSiteNames = map[http.SameSite]string{
+	http.SameSiteDefaultMode: "Default",
+	http.SameSiteLaxMode:     "Lax",
+	http.SameSiteStrictMode:  "Strict",
+	http.SameSiteNoneMode:    "None",
+}
+
+func newCookieRecord(c storedCookie) cookieRecord {
+	r := cookieRecord{
+		Name:         c.Name,
+		Value:        c.Value,
+		Quoted:       c.Quoted,
+		Path:         c.Path,
+		Domain:       c.Domain,
+		MaxAge:       c.MaxAge,
+		Secure:       c.Secure,
+		HttpOnly:     c.HttpOnly,
+		SameSite:     sameSiteNames[c.SameSite],
+		Partitioned:  c.Partitioned,
+		PartitionKey: c.PartitionKey,
+		DefaultPath:  c.DefaultPath,
+		Unparsed:     c.Unparsed,
+	}
+	if !c.Expires.IsZero() {
+		t := c.Expires
+		r.Expires = &t
+	}
+	if !c.LastAccess.IsZero() {
+		t := c.LastAccess
+		r.LastAccess = &t
+	}
+	return r
+}
+
+func (r *cookieRecord) toCookie() (storedCookie, error) {
+	c := &http.Cookie{
+		Name:        r.Name,
+		Value:       r.Value,
+		Quoted:      r.Quoted,
+		Path:        r.Path,
+		Domain:      r.Domain,
+		MaxAge:      r.MaxAge,
+		Secure:      r.Secure,
+		HttpOnly:    r.HttpOnly,
+		Partitioned: r.Partitioned,
+		Unparsed:    r.Unparsed,
+	}
+	if r.Expires != nil {
+		c.Expires = *r.Expires
+	}
+	if r.SameSite != "" {
+		ok := false
+		for mode, name := range sameSiteNames {
+			if name == r.SameSite {
+				c.SameSite = mode
+				ok = true
+			}
+		}
+		if !ok {
+			return storedCookie{}, fmt.Errorf("collysqlite: invalid stored SameSite %q", r.SameSite)
+		}
+	}
+	sc := storedCookie{Cookie: c, PartitionKey: r.PartitionKey, DefaultPath: r.DefaultPath}
+	if r.LastAccess != nil {
+		sc.LastAccess = *r.LastAccess
+	}
+	return sc, nil
+}
+
+// clampExpiry returns c, or a copy of c if its expiry is later than
+// can be stored, expiring at the latest time that can.
+func clampExpiry(c *http.Cookie) *http.Cookie {
+	max := time.Unix(maxCookieExpiry, 0).UTC()
+	if !c.Expires.After(max) {
+		return c
+	}
+	cc := *c
+	cc.Expires = max
+	return &cc
+}
+
+// stringify serialises cookies as a JSON array of cookieRecords,
+// or the empty string if there are none. Cookies that net/http
+// would not send, having invalid names, are dropped.
+func stringify(cookies []storedCookie) (string, error) {
+	rs := make([]cookieRecord, 0, len(cookies))
+	for _, c := range cookies {
+		if c.String() == "" {
+			continue
+		}
+		rs = append(rs, newCookieRecord(c))
+	}
+	if len(rs) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(rs)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// unstringify parses cookies serialised by stringify, or by earlier
+// versions of this package as Set-Cookie lines, which are given host's
+// partition if they are Partitioned.
+func unstringify(s string, host string) ([]storedCookie, error) {
+	if strings.HasPrefix(s, "[") {
+		var rs []cookieRecord
+		err := json.Unmarshal([]byte(s), &rs)
+		if err != nil {
+			return nil, fmt.Errorf("collysqlite: invalid stored cookies for %s: %w", host, err)
+		}
+		cookies := make([]storedCookie, len(rs))
+		for i := range rs {
+			cookies[i], err = rs[i].toCookie()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return cookies, nil
+	}
+	h := http.Header{}
+	for _, c := range strings.Split(s, "\n") {
+		h.Add("Set-Cookie", c)
+	}
+	r := http.Response{Header: h}
+	site := siteOf(host)
+	var cookies []storedCookie
+	for _, c := range r.Cookies() {
+		sc := storedCookie{Cookie: c}
+		if c.Partitioned {
+			sc.PartitionKey = site
+		}
+		cookies = append(cookies, sc)
+	}
+	return cookies, nil
+}
+
+// countStored returns the number of cookies serialised in s,
+// without fully parsing them.
+func countStored(s string) int {
+	if s == "" {
+		return 0
+	}
+	if strings.HasPrefix(s, "[") {
+		var rs []json.RawMessage
+		if json.Unmarshal([]byte(s), &rs) == nil {
+			return len(rs)
+		}
+	}
+	n := 0
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,99 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CookieStore", func() {
+
+	stores := map[string]func() collysqlite.CookieStore{
+		"MemoryCookieStore": func() collysqlite.CookieStore {
+			return collysqlite.NewMemoryCookieStore()
+		},
+		"SQLiteCookieStore": func() collysqlite.CookieStore {
+			return collysqlite.NewSQLiteCookieStore("test-db-" + randomName())
+		},
+	}
+
+	for name, newStore := range stores {
+		name, newStore := name, newStore
+
+		Context(name, func() {
+
+			It("should set and get serialised cookies", func() {
+				s := newStore()
+				Expect(s.Init()).To(BeNil())
+				defer s.Destroy()
+
+				// Get non-existing.
+				got, err := s.Cookies("example.org")
+				Expect(err).To(BeNil())
+				Expect(got).To(Equal(""))
+				// Set.
+				Expect(s.SetCookies("example.org", "a=1")).To(BeNil())
+				Expect(s.SetCookies("example.com", "b=2")).To(BeNil())
+				got, err = s.Cookies("example.org")
+				Expect(err).To(BeNil())
+				Expect(got).To(Equal("a=1"))
+				// Replace.
+				Expect(s.SetCookies("example.org", "a=3")).To(BeNil())
+				got, err = s.Cookies("example.org")
+				Expect(err).To(BeNil())
+				Expect(got).To(Equal("a=3"))
+				// Hosts.
+				hosts, err := s.Hosts()
+				Expect(err).To(BeNil())
+				Expect(hosts).To(Equal([]string{"example.com", "example.org"}))
+			})
+
+			It("should back a CookieStoreJar", func() {
+				j := collysqlite.NewCookieStoreJar(newStore())
+				Expect(j.Init()).To(BeNil())
+				defer j.Destroy()
+
+				url, _ := url.Parse("http://example.org")
+				cookies := []*http.Cookie{
+					&http.Cookie{
+						Name:   "cookie1_name",
+						Value:  "cookie1_value",
+						Path:   "/",
+						Domain: ".example.org",
+					},
+					&http.Cookie{
+						Name:   "cookie2_name",
+						Value:  "cookie2_value",
+						Path:   "/",
+						Domain: ".example.org",
+						Secure: true,
+					},
+				}
+				Expect(j.SetCookies(url, cookies)).To(BeNil())
+				more := []*http.Cookie{
+					&http.Cookie{
+						Name:   "cookie1_name",
+						Value:  "cookie1_new_value",
+						Path:   "/",
+						Domain: ".example.org",
+					},
+				}
+				Expect(j.SetCookies(url, more)).To(BeNil())
+
+				got, err := j.Cookies(url)
+				Expect(err).To(BeNil())
+				Expect(got).To(HaveLen(1))
+				Expect(got[0].String()).To(Equal("cookie1_name=cookie1_new_value; Path=/; Domain=example.org"))
+
+				url.Scheme = "https"
+				got, err = j.Cookies(url)
+				Expect(err).To(BeNil())
+				Expect(got).To(HaveLen(2))
+			})
+		})
+	}
+})
@@ -0,0 +1,166 @@
+package collysqlite
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeyProvider supplies the keys used to encrypt data at rest with AES-GCM.
+// Keys must be 16, 24 or 32 bytes long, selecting AES-128, AES-192 or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt with, and its ID.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given ID, to decrypt with.
+	Key(id string) ([]byte, error)
+}
+
+// ErrUnknownKey is returned when data was encrypted with a key
+// that the KeyProvider does not have.
+var ErrUnknownKey = errors.New("collysqlite: unknown encryption key")
+
+// NewStaticKeyProvider returns a KeyProvider that encrypts with the current key,
+// and decrypts with either the current key or any of the previous keys.
+// Keeping previous keys allows data to be read, and re-encrypted with the
+// current key, after a key rotation.
+func NewStaticKeyProvider(current []byte, previous ...[]byte) KeyProvider {
+	p := &staticKeyProvider{
+		current: keyID(current),
+		keys:    make(map[string][]byte),
+	}
+	for _, k := range append([][]byte{current}, previous...) {
+		p.keys[keyID(k)] = k
+	}
+	return p
+}
+
+type staticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func (p *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *staticKeyProvider) Key(id string) ([]byte, error) {
+	k, ok := p.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return k, nil
+}
+
+// keyID derives a non-secret ID from a key.
+func keyID(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:4])
+}
+
+// encryptedMagic prefixes all encrypted data.
+var encryptedMagic = []byte("\x00collysqlite-enc1:")
+
+// encryptedTextPrefix prefixes encrypted data held in text columns,
+// which is otherwise base64 encoded. It cannot begin a serialised cookie,
+// as ':' is not valid in a cookie name.
+const encryptedTextPrefix = "enc1:"
+
+// rotateKeysBatchSize is the number of rows that RotateKeys
+// re-encrypts in each transaction.
+const rotateKeysBatchSize = 100
+
+// encrypt seals plaintext with the current key of keys, binding it to aad.
+// The result is: magic, key ID length, key ID, nonce, ciphertext.
+func encrypt(keys KeyProvider, plaintext, aad []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("collysqlite: encryption key id too long")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 0, len(encryptedMagic)+1+len(id)+gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	b = append(b, encryptedMagic...)
+	b = append(b, byte(len(id)))
+	b = append(b, id...)
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, nonce...)
+	return gcm.Seal(b, nonce, plaintext, aad), nil
+}
+
+// decrypt opens data sealed by encrypt. Data that is not encrypted is
+// returned unchanged, so that existing plaintext remains readable.
+func decrypt(keys KeyProvider, data, aad []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("collysqlite: data is encrypted but no KeyProvider is set")
+	}
+	b := data[len(encryptedMagic):]
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, fmt.Errorf("collysqlite: malformed encrypted data")
+	}
+	id := string(b[1 : 1+b[0]])
+	b = b[1+b[0]:]
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, fmt.Errorf("collysqlite: malformed encrypted data")
+	}
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], aad)
+}
+
+// encryptText is like encrypt, for data held in text columns.
+func encryptText(keys KeyProvider, plaintext, aad string) (string, error) {
+	b, err := encrypt(keys, []byte(plaintext), []byte(aad))
+	if err != nil {
+		return "", err
+	}
+	return encryptedTextPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decryptText is like decrypt, for data held in text columns.
+func decryptText(keys KeyProvider, data, aad string) (string, error) {
+	if !strings.HasPrefix(data, encryptedTextPrefix) {
+		return data, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(data[len(encryptedTextPrefix):])
+	if err != nil {
+		return "", fmt.Errorf("collysqlite: malformed encrypted data: %s", err)
+	}
+	if !bytes.HasPrefix(b, encryptedMagic) {
+		return "", fmt.Errorf("collysqlite: malformed encrypted data")
+	}
+	p, err := decrypt(keys, b, []byte(aad))
+	return string(p), err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,193 @@
+package collysqlite_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/jimsmart/collysqlite"
+	"github.com/jmoiron/sqlx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encryption", func() {
+
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	secret := "secret_session_token"
+	u, _ := url.Parse("http://example.org")
+
+	fileContains := func(path, s string) bool {
+		b, err := ioutil.ReadFile(path)
+		Expect(err).To(BeNil())
+		return bytes.Contains(b, []byte(s))
+	}
+
+	It("should encrypt cookies at rest", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.Keys = collysqlite.NewStaticKeyProvider(key1)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: secret},
+		})).To(BeNil())
+		Expect(fileContains(j.Path, secret)).To(BeFalse())
+
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Value).To(Equal(secret))
+
+		// Wrong key.
+		other := collysqlite.NewCookieJar(name)
+		other.Keys = collysqlite.NewStaticKeyProvider(key2)
+		_, err = other.Cookies(u)
+		Expect(err).To(Equal(collysqlite.ErrUnknownKey))
+	})
+
+	It("should read existing plaintext cookies and rotate keys", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		Expect(j.SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: secret},
+		})).To(BeNil())
+		Expect(fileContains(j.Path, secret)).To(BeTrue())
+
+		// Encrypt existing plaintext.
+		j1 := collysqlite.NewCookieJar(name)
+		j1.Keys = collysqlite.NewStaticKeyProvider(key1)
+		got, err := j1.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(j1.RotateKeys()).To(BeNil())
+
+		// Rotate from key1 to key2.
+		j2 := collysqlite.NewCookieJar(name)
+		j2.Keys = collysqlite.NewStaticKeyProvider(key2, key1)
+		Expect(j2.RotateKeys()).To(BeNil())
+
+		j3 := collysqlite.NewCookieJar(name)
+		j3.Keys = collysqlite.NewStaticKeyProvider(key2)
+		got, err = j3.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Value).To(Equal(secret))
+		_, err = j1.Cookies(u)
+		Expect(err).To(Equal(collysqlite.ErrUnknownKey))
+	})
+
+	It("should encrypt profiles", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.Keys = collysqlite.NewStaticKeyProvider(key1)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		j.Profile("alice").SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: secret},
+		})
+		Expect(fileContains(j.Path, secret)).To(BeFalse())
+		Expect(j.CloneProfile("alice", "bob")).To(BeNil())
+		got, err := j.Profile("bob").Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Value).To(Equal(secret))
+	})
+
+	It("should bind encrypted cookies to their profile", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		j.Keys = collysqlite.NewStaticKeyProvider(key1)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		Expect(j.Profile("alice").SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "session", Value: secret},
+		})).To(BeNil())
+		db, err := sqlx.Connect("sqlite3", j.Path)
+		Expect(err).To(BeNil())
+		defer db.Close()
+		_, err = db.Exec("UPDATE cookie_jar SET profile = 'mallory' WHERE profile = 'alice'")
+		Expect(err).To(BeNil())
+		_, err = j.Profile("mallory").Cookies(u)
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should rotate keys in batches", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewSQLiteCookieStore(name)
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		c := collysqlite.NewCache(name)
+		Expect(c.Init()).To(BeNil())
+		defer c.Destroy()
+		for i := 0; i < 250; i++ {
+			host := fmt.Sprintf("host%d.example.org", i)
+			Expect(s.SetCookies(host, "a=1")).To(BeNil())
+			Expect(c.Put("http://"+host, []byte(secret))).To(BeNil())
+		}
+
+		s.Keys = collysqlite.NewStaticKeyProvider(key1)
+		Expect(s.RotateKeys()).To(BeNil())
+		c.Keys = collysqlite.NewStaticKeyProvider(key1)
+		Expect(c.RotateKeys()).To(BeNil())
+
+		// Every batch was encrypted.
+		other := collysqlite.NewCache(name)
+		other.Keys = collysqlite.NewStaticKeyProvider(key2)
+		_, err := other.Get("http://host249.example.org")
+		Expect(err).To(Equal(collysqlite.ErrUnknownKey))
+		otherStore := collysqlite.NewSQLiteCookieStore(name)
+		otherStore.Keys = collysqlite.NewStaticKeyProvider(key2)
+		_, err = otherStore.Cookies("host99.example.org")
+		Expect(err).To(Equal(collysqlite.ErrUnknownKey))
+
+		for i := 0; i < 250; i++ {
+			host := fmt.Sprintf("host%d.example.org", i)
+			cs, err := s.Cookies(host)
+			Expect(err).To(BeNil())
+			Expect(cs).NotTo(BeEmpty())
+			got, err := c.Get("http://" + host)
+			Expect(err).To(BeNil())
+			Expect(string(got)).To(Equal(secret))
+		}
+	})
+
+	It("should encrypt cached data at rest", func() {
+		name := "test-db-" + randomName()
+		c := collysqlite.NewCache(name)
+		c.Keys = collysqlite.NewStaticKeyProvider(key1)
+		Expect(c.Init()).To(BeNil())
+		defer c.Destroy()
+
+		Expect(c.Put("http://example.org", []byte(secret))).To(BeNil())
+		Expect(fileContains(c.Path, secret)).To(BeFalse())
+		got, err := c.Get("http://example.org")
+		Expect(err).To(BeNil())
+		Expect(string(got)).To(Equal(secret))
+
+		// Rotate.
+		c.Keys = collysqlite.NewStaticKeyProvider(key2, key1)
+		Expect(c.RotateKeys()).To(BeNil())
+		c.Keys = collysqlite.NewStaticKeyProvider(key2)
+		got, err = c.Get("http://example.org")
+		Expect(err).To(BeNil())
+		Expect(string(got)).To(Equal(secret))
+	})
+
+	It("should reject invalid keys", func() {
+		c := collysqlite.NewCache("test-db-" + randomName())
+		c.Keys = collysqlite.NewStaticKeyProvider([]byte("too short"))
+		Expect(c.Init()).To(BeNil())
+		defer c.Destroy()
+		Expect(c.Put("http://example.org", []byte(secret))).NotTo(BeNil())
+	})
+})
@@ -0,0 +1,42 @@
+package collysqlite
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MultiError holds the errors of several operations that failed together,
+// such as when destroying each component of a Storage.
+// It works with errors.Is and errors.As, which match any of its errors.
+type MultiError []error
+
+// newMultiError returns the non-nil errors of errs as a MultiError,
+// or nil if there are none.
+func newMultiError(errs []error) error {
+	var m MultiError
+	for _, err := range errs {
+		if err != nil {
+			m = append(m, err)
+		}
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+	s := make([]string, len(m))
+	for i, err := range m {
+		s[i] = err.Error()
+	}
+	return fmt.Sprintf("collysqlite: %d errors: %s", len(m), strings.Join(s, "; "))
+}
+
+// Unwrap returns the errors, for errors.Is and errors.As.
+func (m MultiError) Unwrap() []error {
+	return []error(m)
+}
@@ -0,0 +1,38 @@
+package collysqlite_test
+
+import (
+	"errors"
+	"os"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("MultiError", func() {
+
+	errFoo := errors.New("foo")
+	errBar := errors.New("bar")
+
+	It("should report every error", func() {
+		err := error(collysqlite.MultiError{errFoo, errBar})
+		Expect(err.Error()).To(Equal("collysqlite: 2 errors: foo; bar"))
+		Expect(collysqlite.MultiError{errFoo}.Error()).To(Equal("foo"))
+	})
+
+	It("should work with errors.Is and errors.As", func() {
+		pathErr := &os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}
+		err := error(collysqlite.MultiError{errFoo, pathErr})
+		Expect(errors.Is(err, errFoo)).To(BeTrue())
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		Expect(errors.Is(err, errBar)).To(BeFalse())
+
+		var pe *os.PathError
+		Expect(errors.As(err, &pe)).To(BeTrue())
+		Expect(pe).To(Equal(pathErr))
+		var m collysqlite.MultiError
+		Expect(errors.As(err, &m)).To(BeTrue())
+		Expect(m).To(HaveLen(2))
+	})
+})
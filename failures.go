@@ -0,0 +1,376 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math"
+	"net"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// next_retry_at is held as Unix nanoseconds, so that it compares correctly.
+	createFailureDDL = `
+		CREATE TABLE IF NOT EXISTS failure (
+			url				TEXT NOT NULL,
+			class			TEXT NOT NULL,
+			status_code		INTEGER NOT NULL,
+			attempts		INTEGER NOT NULL,
+			last_error		TEXT NOT NULL,
+			next_retry_at	INTEGER NOT NULL,
+			modified_at		DATETIME NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (url)
+		);
+		CREATE INDEX IF NOT EXISTS idx_failure_next_retry_at ON failure(next_retry_at);
+	`
+	addFailureRunDDL = `
+		ALTER TABLE failure ADD COLUMN run_id INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS idx_failure_run_id ON failure(run_id);
+	`
+	// Rebuilds the table, as SQLite cannot alter a primary key,
+	// so that each run may record a failure of a URL.
+	rekeyFailureRunDDL = `
+		CREATE TABLE failure_rekeyed (
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			url				TEXT NOT NULL,
+			class			TEXT NOT NULL,
+			status_code		INTEGER NOT NULL,
+			attempts		INTEGER NOT NULL,
+			last_error		TEXT NOT NULL,
+			next_retry_at	INTEGER NOT NULL,
+			modified_at		DATETIME NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (run_id, url)
+		);
+		INSERT INTO failure_rekeyed (run_id, url, class, status_code, attempts, last_error, next_retry_at, modified_at, created_at)
+			SELECT run_id, url, class, status_code, attempts, last_error, next_retry_at, modified_at, created_at FROM failure;
+		DROP TABLE failure;
+		ALTER TABLE failure_rekeyed RENAME TO failure;
+		CREATE INDEX IF NOT EXISTS idx_failure_next_retry_at ON failure(run_id, next_retry_at);
+	`
+	dropFailureDDL = `
+		DROP INDEX IF EXISTS idx_failure_run_id;
+		DROP INDEX IF EXISTS idx_failure_next_retry_at;
+		DROP TABLE IF EXISTS failure;
+	`
+)
+
+// failureMigrations are the steps that create and upgrade the failure schema.
+var failureMigrations = []migration{
+	execMigration(createFailureDDL),
+	execMigration(addFailureRunDDL),
+	execMigration(rekeyFailureRunDDL),
+}
+
+// FailureClass is the kind of error that caused a request to fail.
+type FailureClass string
+
+const (
+	FailureNetwork FailureClass = "network"
+	FailureTimeout FailureClass = "timeout"
+	FailureHTTP    FailureClass = "http"
+)
+
+// ClassifyFailure returns the class of a failure with the given
+// HTTP status code, which is zero if there was no response, and error.
+func ClassifyFailure(statusCode int, err error) FailureClass {
+	if statusCode >= 400 {
+		return FailureHTTP
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return FailureTimeout
+	}
+	return FailureNetwork
+}
+
+// Backoff calculates exponentially increasing delays between retries.
+// Its zero value behaves as DefaultBackoff.
+type Backoff struct {
+	// Base is the delay after the first failure,
+	// it doubles with each further failure.
+	// Zero or less uses DefaultBackoff.Base.
+	Base time.Duration
+	// Max is the longest delay. Zero uses DefaultBackoff.Max,
+	// and a negative value means no maximum.
+	Max time.Duration
+}
+
+// DefaultBackoff is the Backoff used by NewFailures.
+var DefaultBackoff = Backoff{
+	Base: time.Minute,
+	Max:  24 * time.Hour,
+}
+
+// Delay returns the delay before retrying after the given number of attempts.
+func (b Backoff) Delay(attempts int) time.Duration {
+	if b.Base <= 0 {
+		b.Base = DefaultBackoff.Base
+	}
+	if b.Max == 0 {
+		b.Max = DefaultBackoff.Max
+	}
+	d := b.Base
+	for i := 1; i < attempts && d <= math.MaxInt64/2; i++ {
+		if b.Max > 0 && d >= b.Max {
+			break
+		}
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	return d
+}
+
+// Failure is the record of a URL whose requests have failed.
+type Failure struct {
+	// RunID is the Run in which the URL failed, see Runs.
+	RunID int64        `db:"run_id"`
+	URL   string       `db:"url"`
+	Class FailureClass `db:"class"`
+	// StatusCode is zero if there was no response.
+	StatusCode int    `db:"status_code"`
+	Attempts   int    `db:"attempts"`
+	LastError  string `db:"last_error"`
+	// NextRetry is when the URL may next be retried.
+	NextRetry  time.Time `db:"-"`
+	ModifiedAt time.Time `db:"modified_at"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+type failureRecord struct {
+	Failure
+	NextRetryAt int64 `db:"next_retry_at"`
+}
+
+func (r *failureRecord) failure() Failure {
+	f := r.Failure
+	f.NextRetry = time.Unix(0, r.NextRetryAt)
+	return f
+}
+
+// Failures records failed requests, such as from colly's OnError,
+// and when they should be retried. It is separate from VisitTracker,
+// so that a failed request is not marked as visited.
+type Failures struct {
+	Path    string
+	Backoff Backoff
+	// RunID, if set, is the Run that failures are tagged with,
+	// and whose failures are read, see Runs.
+	RunID int64
+}
+
+func NewFailures(path string) *Failures {
+	f := &Failures{
+		Path:    path + ".sqlite",
+		Backoff: DefaultBackoff,
+	}
+	return f
+}
+
+func (f *Failures) Init() error {
+	return f.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (f *Failures) InitContext(ctx context.Context) error {
+	err := ensurePathExists(f.Path)
+	if err != nil {
+		return err
+	}
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrate(ctx, db, "failure", failureMigrations)
+}
+
+func (f *Failures) Destroy() error {
+	return f.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (f *Failures) DestroyContext(ctx context.Context) error {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, dropFailureDDL)
+	if err != nil {
+		return err
+	}
+	err = forgetSchema(ctx, db, "failure")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, f.Path)
+}
+
+// Failed records a failed request for u, with the HTTP status code,
+// which is zero if there was no response, and error. It returns the
+// updated record, whose NextRetry is calculated by Backoff.
+func (f *Failures) Failed(u string, statusCode int, ferr error) (*Failure, error) {
+	return f.FailedContext(context.Background(), u, statusCode, ferr)
+}
+
+// FailedContext is like Failed but includes a context.
+func (f *Failures) FailedContext(ctx context.Context, u string, statusCode int, ferr error) (*Failure, error) {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	r := &failureRecord{}
+	err = tx.GetContext(ctx, r, "SELECT * FROM failure WHERE run_id = ? AND url = ?", f.RunID, u)
+	if err == sql.ErrNoRows {
+		r.URL = u
+		r.CreatedAt = now
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.RunID = f.RunID
+	r.Class = ClassifyFailure(statusCode, ferr)
+	r.StatusCode = statusCode
+	r.Attempts++
+	r.LastError = ""
+	if ferr != nil {
+		r.LastError = ferr.Error()
+	}
+	r.NextRetryAt = now.Add(f.Backoff.Delay(r.Attempts)).UnixNano()
+	r.ModifiedAt = now
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT OR REPLACE INTO failure (run_id, url, class, status_code, attempts, last_error, next_retry_at, modified_at, created_at)
+		VALUES (:run_id, :url, :class, :status_code, :attempts, :last_error, :next_retry_at, :modified_at, :created_at)`, r)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	ff := r.failure()
+	return &ff, nil
+}
+
+// Failure returns the failure record for u, or nil if there is none.
+func (f *Failures) Failure(u string) (*Failure, error) {
+	return f.FailureContext(context.Background(), u)
+}
+
+// FailureContext is like Failure but includes a context.
+func (f *Failures) FailureContext(ctx context.Context, u string) (*Failure, error) {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	r := &failureRecord{}
+	err = db.GetContext(ctx, r, "SELECT * FROM failure WHERE run_id = ? AND url = ?", f.RunID, u)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ff := r.failure()
+	return &ff, nil
+}
+
+// ListFailures returns all failure records, in URL order.
+func (f *Failures) ListFailures() ([]Failure, error) {
+	return f.ListFailuresContext(context.Background())
+}
+
+// ListFailuresContext is like ListFailures but includes a context.
+func (f *Failures) ListFailuresContext(ctx context.Context) ([]Failure, error) {
+	return f.selectFailures(ctx, "SELECT * FROM failure WHERE run_id = ? ORDER BY url", f.RunID)
+}
+
+// DueFailures returns the failure records that are due to be retried
+// at time t, such as for re-queueing, in order of when they became due.
+func (f *Failures) DueFailures(t time.Time) ([]Failure, error) {
+	return f.DueFailuresContext(context.Background(), t)
+}
+
+// DueFailuresContext is like DueFailures but includes a context.
+func (f *Failures) DueFailuresContext(ctx context.Context, t time.Time) ([]Failure, error) {
+	return f.selectFailures(ctx, "SELECT * FROM failure WHERE run_id = ? AND next_retry_at <= ? ORDER BY next_retry_at, url", f.RunID, t.UnixNano())
+}
+
+func (f *Failures) selectFailures(ctx context.Context, query string, args ...interface{}) ([]Failure, error) {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var rs []failureRecord
+	err = db.SelectContext(ctx, &rs, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	fs := make([]Failure, len(rs))
+	for i := range rs {
+		fs[i] = rs[i].failure()
+	}
+	return fs, nil
+}
+
+// ClearFailure removes the failure record for u,
+// such as when a retry has succeeded.
+func (f *Failures) ClearFailure(u string) error {
+	return f.ClearFailureContext(context.Background(), u)
+}
+
+// ClearFailureContext is like ClearFailure but includes a context.
+func (f *Failures) ClearFailureContext(ctx context.Context, u string) error {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM failure WHERE run_id = ? AND url = ?", f.RunID, u)
+	return err
+}
+
+func (f *Failures) deleteRun(ctx context.Context, runID int64) error {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM failure WHERE run_id = ?", runID)
+	return err
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the store is in use.
+func (f *Failures) Backup(destPath string, progress func(BackupProgress)) error {
+	return f.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (f *Failures) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, f.Path, destPath, progress)
+}
+
+// connect begins transactions immediately, so that concurrent
+// failures of the same URL are counted correctly.
+func (f *Failures) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", "file:"+f.Path+"?_busy_timeout="+busyTimeout+"&_txlock=immediate")
+}
@@ -0,0 +1,96 @@
+package collysqlite_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Failures", func() {
+
+	var f *collysqlite.Failures
+
+	BeforeEach(func() {
+		f = collysqlite.NewFailures("test-db-" + randomName())
+		Expect(f.Init()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(f.Destroy()).To(BeNil())
+		Expect(f.Path).NotTo(BeAnExistingFile())
+	})
+
+	It("should classify failures", func() {
+		Expect(collysqlite.ClassifyFailure(503, errors.New("Service Unavailable"))).To(Equal(collysqlite.FailureHTTP))
+		Expect(collysqlite.ClassifyFailure(0, fmt.Errorf("get: %w", context.DeadlineExceeded))).To(Equal(collysqlite.FailureTimeout))
+		Expect(collysqlite.ClassifyFailure(0, errors.New("connection refused"))).To(Equal(collysqlite.FailureNetwork))
+	})
+
+	It("should back off exponentially", func() {
+		b := collysqlite.Backoff{Base: time.Second, Max: 10 * time.Second}
+		Expect(b.Delay(1)).To(Equal(time.Second))
+		Expect(b.Delay(2)).To(Equal(2 * time.Second))
+		Expect(b.Delay(4)).To(Equal(8 * time.Second))
+		Expect(b.Delay(5)).To(Equal(10 * time.Second))
+		Expect(b.Delay(1000)).To(Equal(10 * time.Second))
+		b.Max = -1
+		Expect(b.Delay(1000)).To(BeNumerically(">", 24*time.Hour))
+	})
+
+	It("should default a zero Backoff", func() {
+		var b collysqlite.Backoff
+		Expect(b.Delay(1)).To(Equal(collysqlite.DefaultBackoff.Base))
+		Expect(b.Delay(1000)).To(Equal(collysqlite.DefaultBackoff.Max))
+		b = collysqlite.Backoff{Base: time.Second}
+		Expect(b.Delay(1000)).To(Equal(collysqlite.DefaultBackoff.Max))
+	})
+
+	It("should record failures and list those due", func() {
+		u := "http://example.org/"
+		got, err := f.Failure(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+
+		before := time.Now()
+		got, err = f.Failed(u, 0, errors.New("connection refused"))
+		Expect(err).To(BeNil())
+		Expect(got.Attempts).To(Equal(1))
+		Expect(got.Class).To(Equal(collysqlite.FailureNetwork))
+		Expect(got.NextRetry).To(BeTemporally(">=", before.Add(time.Minute)))
+
+		got, err = f.Failed(u, 500, errors.New("Internal Server Error"))
+		Expect(err).To(BeNil())
+		Expect(got.Attempts).To(Equal(2))
+		Expect(got.Class).To(Equal(collysqlite.FailureHTTP))
+		Expect(got.StatusCode).To(Equal(500))
+		Expect(got.LastError).To(Equal("Internal Server Error"))
+		Expect(got.NextRetry).To(BeTemporally(">=", before.Add(2*time.Minute)))
+
+		_, err = f.Failed("http://example.com/", 404, errors.New("Not Found"))
+		Expect(err).To(BeNil())
+
+		all, err := f.ListFailures()
+		Expect(err).To(BeNil())
+		Expect(all).To(HaveLen(2))
+		Expect(all[0].URL).To(Equal("http://example.com/"))
+
+		due, err := f.DueFailures(time.Now())
+		Expect(err).To(BeNil())
+		Expect(due).To(BeEmpty())
+		due, err = f.DueFailures(time.Now().Add(90 * time.Second))
+		Expect(err).To(BeNil())
+		Expect(due).To(HaveLen(1))
+		Expect(due[0].URL).To(Equal("http://example.com/"))
+
+		Expect(f.ClearFailure(u)).To(BeNil())
+		got, err = f.Failure(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+	})
+})
@@ -0,0 +1,315 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// not_before is held as Unix nanoseconds, so that it compares correctly.
+	createFrontierDDL = `
+		CREATE TABLE IF NOT EXISTS frontier (
+			id				INTEGER NOT NULL,
+			host			TEXT NOT NULL,
+			url				TEXT NOT NULL,
+			data			BLOB,
+			priority		INTEGER NOT NULL,
+			not_before		INTEGER NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_frontier_host ON frontier(host, priority, not_before);
+		CREATE INDEX IF NOT EXISTS idx_frontier_not_before ON frontier(not_before);
+		CREATE TABLE IF NOT EXISTS frontier_host (
+			host			TEXT NOT NULL,
+			served			INTEGER NOT NULL,
+			PRIMARY KEY (host)
+		);
+	`
+	// Rebuilds the table, as SQLite cannot alter a primary key, so that
+	// each run has its own frontier. Requests enqueued before then
+	// belong to no run.
+	addFrontierRunDDL = `
+		CREATE TABLE frontier_rekeyed (
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			id				INTEGER NOT NULL,
+			host			TEXT NOT NULL,
+			url				TEXT NOT NULL,
+			data			BLOB,
+			priority		INTEGER NOT NULL,
+			not_before		INTEGER NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (run_id, id)
+		);
+		INSERT INTO frontier_rekeyed (id, host, url, data, priority, not_before, created_at)
+			SELECT id, host, url, data, priority, not_before, created_at FROM frontier;
+		DROP TABLE frontier;
+		ALTER TABLE frontier_rekeyed RENAME TO frontier;
+		CREATE INDEX IF NOT EXISTS idx_frontier_host ON frontier(run_id, host, priority, not_before);
+		CREATE INDEX IF NOT EXISTS idx_frontier_not_before ON frontier(run_id, not_before);
+	`
+	dropFrontierDDL = `
+		DROP TABLE IF EXISTS frontier_host;
+		DROP INDEX IF EXISTS idx_frontier_not_before;
+		DROP INDEX IF EXISTS idx_frontier_host;
+		DROP TABLE IF EXISTS frontier;
+	`
+)
+
+// frontierMigrations are the steps that create and upgrade the frontier schema.
+var frontierMigrations = []migration{
+	execMigration(createFrontierDDL),
+	execMigration(addFrontierRunDDL),
+}
+
+// ErrFrontierEmpty is returned by Dequeue when no requests are ready.
+var ErrFrontierEmpty = errors.New("collysqlite: no requests are ready")
+
+// FrontierRequest is a request waiting in a Frontier.
+type FrontierRequest struct {
+	// ID is the request ID, as given to VisitTracker.
+	ID  uint64 `db:"-"`
+	URL string `db:"url"`
+	// Data is optional, such as a serialised request.
+	Data []byte `db:"data"`
+	// Priority orders requests to the same host, highest first.
+	Priority int `db:"priority"`
+	// NotBefore is the earliest time that the request may be dequeued.
+	// The zero time means now.
+	NotBefore time.Time `db:"-"`
+}
+
+type frontierRecord struct {
+	FrontierRequest
+	// ID is the request ID's bit pattern, as SQLite has no unsigned integers.
+	ID        int64     `db:"id"`
+	RunID     int64     `db:"run_id"`
+	Host      string    `db:"host"`
+	NotBefore int64     `db:"not_before"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// Frontier is a persistent schedule of requests to be made.
+// Requests are dequeued round-robin across hosts, so that one large site
+// cannot starve the others, and by priority within each host.
+//
+// A Frontier shares its database with a VisitTracker, so that requests
+// already visited can be skipped as they are enqueued.
+type Frontier struct {
+	Path string
+	// RunID is the Run that requests are enqueued for and dequeued from,
+	// and whose visits are skipped, as for VisitTracker.
+	RunID int64
+}
+
+// NewFrontier returns a Frontier for the database of the VisitTracker
+// with the same path.
+func NewFrontier(path string) *Frontier {
+	f := &Frontier{
+		Path: path + ".sqlite",
+	}
+	return f
+}
+
+func (f *Frontier) Init() error {
+	return f.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (f *Frontier) InitContext(ctx context.Context) error {
+	err := ensurePathExists(f.Path)
+	if err != nil {
+		return err
+	}
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = migrate(ctx, db, "visit", visitMigrations)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, db, "frontier", frontierMigrations)
+}
+
+// Destroy removes the frontier from the database,
+// leaving any visits in place.
+func (f *Frontier) Destroy() error {
+	return f.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (f *Frontier) DestroyContext(ctx context.Context) error {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, dropFrontierDDL)
+	if err != nil {
+		return err
+	}
+	err = forgetSchema(ctx, db, "frontier")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, f.Path)
+}
+
+// Enqueue adds r to the frontier, unless it has already been visited
+// or is already in the frontier. It reports whether r was added.
+func (f *Frontier) Enqueue(r FrontierRequest) (bool, error) {
+	return f.EnqueueContext(context.Background(), r)
+}
+
+// EnqueueContext is like Enqueue but includes a context.
+func (f *Frontier) EnqueueContext(ctx context.Context, r FrontierRequest) (bool, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return false, err
+	}
+	db, err := f.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	now := time.Now()
+	rec := &frontierRecord{
+		FrontierRequest: r,
+		ID:              int64(r.ID),
+		RunID:           f.RunID,
+		Host:            strings.ToLower(u.Host),
+		NotBefore:       now.UnixNano(),
+		CreatedAt:       now,
+	}
+	if !r.NotBefore.IsZero() {
+		rec.NotBefore = r.NotBefore.UnixNano()
+	}
+	// A single statement, so the visited check and the insert are atomic.
+	res, err := db.NamedExecContext(ctx, `
+		INSERT OR IGNORE INTO frontier (run_id, id, host, url, data, priority, not_before, created_at)
+		SELECT :run_id, :id, :host, :url, :data, :priority, :not_before, :created_at
+		WHERE NOT EXISTS (SELECT 1 FROM visit WHERE run_id = :run_id AND id = :id)`, rec)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// Dequeue removes and returns the next ready request, from the host that
+// was least recently served. It returns ErrFrontierEmpty if no requests
+// are ready, which may be because all are scheduled for later.
+func (f *Frontier) Dequeue() (*FrontierRequest, error) {
+	return f.DequeueContext(context.Background())
+}
+
+// DequeueContext is like Dequeue but includes a context.
+func (f *Frontier) DequeueContext(ctx context.Context) (*FrontierRequest, error) {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UnixNano()
+	var host string
+	err = tx.GetContext(ctx, &host, `
+		SELECT f.host FROM frontier f LEFT JOIN frontier_host h ON h.host = f.host
+		WHERE f.run_id = ? AND f.not_before <= ?
+		GROUP BY f.host
+		ORDER BY COALESCE(MAX(h.served), 0), f.host
+		LIMIT 1`, f.RunID, now)
+	if err == sql.ErrNoRows {
+		return nil, ErrFrontierEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	rec := &frontierRecord{}
+	err = tx.GetContext(ctx, rec, `
+		SELECT * FROM frontier
+		WHERE run_id = ? AND host = ? AND not_before <= ?
+		ORDER BY priority DESC, not_before, created_at
+		LIMIT 1`, f.RunID, host, now)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM frontier WHERE run_id = ? AND id = ?", f.RunID, rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO frontier_host (host, served)
+		VALUES (?, (SELECT COALESCE(MAX(served), 0) + 1 FROM frontier_host))
+		ON CONFLICT (host) DO UPDATE SET served = excluded.served`, host)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	r := rec.FrontierRequest
+	r.ID = uint64(rec.ID)
+	r.NotBefore = time.Unix(0, rec.NotBefore)
+	return &r, nil
+}
+
+// FrontierSize returns the number of requests in the run's frontier,
+// including those scheduled for later.
+func (f *Frontier) FrontierSize() (int, error) {
+	return f.FrontierSizeContext(context.Background())
+}
+
+// FrontierSizeContext is like FrontierSize but includes a context.
+func (f *Frontier) FrontierSizeContext(ctx context.Context) (int, error) {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var count int
+	err = db.GetContext(ctx, &count, "SELECT COUNT(*) FROM frontier WHERE run_id = ?", f.RunID)
+	return count, err
+}
+
+func (f *Frontier) deleteRun(ctx context.Context, runID int64) error {
+	db, err := f.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM frontier WHERE run_id = ?", runID)
+	return err
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// The database is shared with a VisitTracker, whose visits are also copied.
+// It is safe to call while the frontier is in use.
+func (f *Frontier) Backup(destPath string, progress func(BackupProgress)) error {
+	return f.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (f *Frontier) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, f.Path, destPath, progress)
+}
+
+// connect begins transactions immediately, so that concurrent
+// dequeues wait for each other rather than failing.
+func (f *Frontier) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", "file:"+f.Path+"?_busy_timeout="+busyTimeout+"&_txlock=immediate")
+}
@@ -0,0 +1,165 @@
+package collysqlite_test
+
+import (
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+	"github.com/jmoiron/sqlx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Frontier", func() {
+
+	var t *collysqlite.VisitTracker
+	var f *collysqlite.Frontier
+
+	BeforeEach(func() {
+		name := "test-db-" + randomName()
+		t = collysqlite.NewVisitTracker(name)
+		Expect(t.Init()).To(BeNil())
+		f = collysqlite.NewFrontier(name)
+		Expect(f.Init()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(f.Destroy()).To(BeNil())
+		Expect(t.Destroy()).To(BeNil())
+		Expect(f.Path).NotTo(BeAnExistingFile())
+	})
+
+	dequeueURLs := func() []string {
+		var urls []string
+		for {
+			r, err := f.Dequeue()
+			if err == collysqlite.ErrFrontierEmpty {
+				return urls
+			}
+			Expect(err).To(BeNil())
+			urls = append(urls, r.URL)
+		}
+	}
+
+	It("should skip visited and queued requests", func() {
+		Expect(t.Visited(1)).To(BeNil())
+		added, err := f.Enqueue(collysqlite.FrontierRequest{ID: 1, URL: "http://example.org/1"})
+		Expect(err).To(BeNil())
+		Expect(added).To(BeFalse())
+		added, err = f.Enqueue(collysqlite.FrontierRequest{ID: 2, URL: "http://example.org/2", Data: []byte{2}})
+		Expect(err).To(BeNil())
+		Expect(added).To(BeTrue())
+		added, err = f.Enqueue(collysqlite.FrontierRequest{ID: 2, URL: "http://example.org/2"})
+		Expect(err).To(BeNil())
+		Expect(added).To(BeFalse())
+		Expect(f.FrontierSize()).To(Equal(1))
+
+		r, err := f.Dequeue()
+		Expect(err).To(BeNil())
+		Expect(r.ID).To(Equal(uint64(2)))
+		Expect(r.Data).To(Equal([]byte{2}))
+		_, err = f.Dequeue()
+		Expect(err).To(Equal(collysqlite.ErrFrontierEmpty))
+	})
+
+	It("should handle request IDs with the high bit set", func() {
+		const id = 1<<63 | 1
+		added, err := f.Enqueue(collysqlite.FrontierRequest{ID: id, URL: "http://example.org/1"})
+		Expect(err).To(BeNil())
+		Expect(added).To(BeTrue())
+		r, err := f.Dequeue()
+		Expect(err).To(BeNil())
+		Expect(r.ID).To(Equal(uint64(id)))
+
+		Expect(t.Visited(id)).To(BeNil())
+		added, err = f.Enqueue(collysqlite.FrontierRequest{ID: id, URL: "http://example.org/1"})
+		Expect(err).To(BeNil())
+		Expect(added).To(BeFalse())
+	})
+
+	It("should dequeue round-robin across hosts, by priority", func() {
+		for i, r := range []collysqlite.FrontierRequest{
+			{URL: "http://a.example/1"},
+			{URL: "http://a.example/2", Priority: 2},
+			{URL: "http://a.example/3", Priority: 1},
+			{URL: "http://b.example/1"},
+			{URL: "http://c.example/1"},
+		} {
+			r.ID = uint64(i + 1)
+			Expect(f.Enqueue(r)).To(BeTrue())
+		}
+		Expect(dequeueURLs()).To(Equal([]string{
+			"http://a.example/2",
+			"http://b.example/1",
+			"http://c.example/1",
+			"http://a.example/3",
+			"http://a.example/1",
+		}))
+	})
+
+	It("should not dequeue requests before their time", func() {
+		later := time.Now().Add(100 * time.Millisecond)
+		Expect(f.Enqueue(collysqlite.FrontierRequest{ID: 1, URL: "http://example.org/later", NotBefore: later})).To(BeTrue())
+		Expect(f.Enqueue(collysqlite.FrontierRequest{ID: 2, URL: "http://example.org/now"})).To(BeTrue())
+		Expect(dequeueURLs()).To(Equal([]string{"http://example.org/now"}))
+		Expect(f.FrontierSize()).To(Equal(1))
+		time.Sleep(time.Until(later))
+		Expect(dequeueURLs()).To(Equal([]string{"http://example.org/later"}))
+	})
+
+	It("should keep each run's frontier separate", func() {
+		f.RunID = 1
+		Expect(f.Enqueue(collysqlite.FrontierRequest{ID: 1, URL: "http://example.org/1"})).To(BeTrue())
+		f.RunID = 2
+		Expect(f.Enqueue(collysqlite.FrontierRequest{ID: 1, URL: "http://example.org/1"})).To(BeTrue())
+		Expect(f.Enqueue(collysqlite.FrontierRequest{ID: 2, URL: "http://example.org/2"})).To(BeTrue())
+		Expect(f.FrontierSize()).To(Equal(2))
+		Expect(dequeueURLs()).To(Equal([]string{"http://example.org/1", "http://example.org/2"}))
+		f.RunID = 1
+		Expect(dequeueURLs()).To(Equal([]string{"http://example.org/1"}))
+	})
+})
+
+var _ = Describe("Frontier migration", func() {
+
+	It("should migrate a frontier created before runs", func() {
+		name := "test-db-" + randomName()
+		f := collysqlite.NewFrontier(name)
+		db, err := sqlx.Connect("sqlite3", f.Path)
+		Expect(err).To(BeNil())
+		_, err = db.Exec(`
+			CREATE TABLE frontier (
+				id				INTEGER NOT NULL,
+				host			TEXT NOT NULL,
+				url				TEXT NOT NULL,
+				data			BLOB,
+				priority		INTEGER NOT NULL,
+				not_before		INTEGER NOT NULL,
+				created_at		DATETIME NOT NULL,
+				PRIMARY KEY (id)
+			);
+			CREATE TABLE frontier_host (
+				host			TEXT NOT NULL,
+				served			INTEGER NOT NULL,
+				PRIMARY KEY (host)
+			);
+			CREATE TABLE schema_version (
+				name			TEXT NOT NULL,
+				version			INTEGER NOT NULL,
+				PRIMARY KEY (name)
+			);
+			INSERT INTO schema_version (name, version) VALUES ('frontier', 1);
+			INSERT INTO frontier (id, host, url, priority, not_before, created_at)
+				VALUES (1, 'example.org', 'http://example.org/', 0, 0, CURRENT_TIMESTAMP);
+		`)
+		Expect(err).To(BeNil())
+		db.Close()
+
+		Expect(f.Init()).To(BeNil())
+		defer collysqlite.NewVisitTracker(name).Destroy()
+		defer f.Destroy()
+		r, err := f.Dequeue()
+		Expect(err).To(BeNil())
+		Expect(r.URL).To(Equal("http://example.org/"))
+	})
+})
@@ -0,0 +1,417 @@
+package collysqlite
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	createLinkDDL = `
+		CREATE TABLE IF NOT EXISTS link (
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			from_id			INTEGER NOT NULL,
+			to_id			INTEGER NOT NULL,
+			from_url		TEXT NOT NULL,
+			to_url			TEXT NOT NULL,
+			anchor_text		TEXT NOT NULL,
+			rel				TEXT NOT NULL,
+			discovered_at	DATETIME NOT NULL,
+			PRIMARY KEY (run_id, from_id, to_id, anchor_text, rel)
+		);
+		CREATE INDEX IF NOT EXISTS idx_link_to_id ON link(run_id, to_id);
+	`
+	dropLinkDDL = `
+		DROP INDEX IF EXISTS idx_link_to_id;
+		DROP TABLE IF EXISTS link;
+	`
+)
+
+// linkMigrations are the steps that create and upgrade the link schema.
+var linkMigrations = []migration{
+	execMigration(createLinkDDL),
+}
+
+// Link is an edge of a LinkGraph, a link from one page to another.
+// Pages are identified by their request IDs, as given to VisitTracker.
+type Link struct {
+	FromID     uint64 `db:"-"`
+	ToID       uint64 `db:"-"`
+	FromURL    string `db:"from_url"`
+	ToURL      string `db:"to_url"`
+	AnchorText string `db:"anchor_text"`
+	Rel        string `db:"rel"`
+	// DiscoveredAt is set by AddLinks.
+	DiscoveredAt time.Time `db:"discovered_at"`
+}
+
+type linkRecord struct {
+	RunID int64 `db:"run_id"`
+	Link
+	// FromID and ToID are the request IDs' bit patterns,
+	// as SQLite has no unsigned integers.
+	FromID int64 `db:"from_id"`
+	ToID   int64 `db:"to_id"`
+}
+
+func (r *linkRecord) link() Link {
+	l := r.Link
+	l.FromID = uint64(r.FromID)
+	l.ToID = uint64(r.ToID)
+	return l
+}
+
+// LinkCount is the number of distinct pages linking to a page.
+type LinkCount struct {
+	ID    uint64 `db:"-"`
+	URL   string `db:"to_url"`
+	Count int    `db:"count"`
+}
+
+type linkCountRecord struct {
+	LinkCount
+	ID int64 `db:"to_id"`
+}
+
+// LinkGraph records the links discovered between pages.
+//
+// A LinkGraph shares its database with a VisitTracker, so that pages
+// that were visited but are not linked to can be found.
+type LinkGraph struct {
+	Path string
+	// RunID, if set, is the Run that links are recorded in and queried,
+	// as for VisitTracker.
+	RunID int64
+}
+
+// NewLinkGraph returns a LinkGraph for the database of the VisitTracker
+// with the same path.
+func NewLinkGraph(path string) *LinkGraph {
+	g := &LinkGraph{
+		Path: path + ".sqlite",
+	}
+	return g
+}
+
+func (g *LinkGraph) Init() error {
+	return g.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (g *LinkGraph) InitContext(ctx context.Context) error {
+	err := ensurePathExists(g.Path)
+	if err != nil {
+		return err
+	}
+	db, err := g.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = migrate(ctx, db, "visit", visitMigrations)
+	if err != nil {
+		return err
+	}
+	return migrate(ctx, db, "link", linkMigrations)
+}
+
+// Destroy removes the link graph from the database,
+// leaving any visits in place.
+func (g *LinkGraph) Destroy() error {
+	return g.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (g *LinkGraph) DestroyContext(ctx context.Context) error {
+	db, err := g.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, dropLinkDDL)
+	if err != nil {
+		return err
+	}
+	err = forgetSchema(ctx, db, "link")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, g.Path)
+}
+
+// AddLinks records the given links, such as those found on one page.
+// Links already recorded, with the same pages, anchor text and rel,
+// are ignored.
+func (g *LinkGraph) AddLinks(links []Link) error {
+	return g.AddLinksContext(context.Background(), links)
+}
+
+// AddLinksContext is like AddLinks but includes a context.
+func (g *LinkGraph) AddLinksContext(ctx context.Context, links []Link) error {
+	db, err := g.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	for _, l := range links {
+		l.DiscoveredAt = now
+		r := &linkRecord{
+			RunID:  g.RunID,
+			Link:   l,
+			FromID: int64(l.FromID),
+			ToID:   int64(l.ToID),
+		}
+		_, err = tx.NamedExecContext(ctx, `
+			INSERT OR IGNORE INTO link (run_id, from_id, to_id, from_url, to_url, anchor_text, rel, discovered_at)
+			VALUES (:run_id, :from_id, :to_id, :from_url, :to_url, :anchor_text, :rel, :discovered_at)`, r)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Outlinks returns the links from the page with the given request ID.
+func (g *LinkGraph) Outlinks(id uint64) ([]Link, error) {
+	return g.OutlinksContext(context.Background(), id)
+}
+
+// OutlinksContext is like Outlinks but includes a context.
+func (g *LinkGraph) OutlinksContext(ctx context.Context, id uint64) ([]Link, error) {
+	return g.selectLinks(ctx, "SELECT * FROM link WHERE run_id = ? AND from_id = ? ORDER BY to_url, anchor_text, rel", g.RunID, int64(id))
+}
+
+// Inlinks returns the links to the page with the given request ID.
+func (g *LinkGraph) Inlinks(id uint64) ([]Link, error) {
+	return g.InlinksContext(context.Background(), id)
+}
+
+// InlinksContext is like Inlinks but includes a context.
+func (g *LinkGraph) InlinksContext(ctx context.Context, id uint64) ([]Link, error) {
+	return g.selectLinks(ctx, "SELECT * FROM link WHERE run_id = ? AND to_id = ? ORDER BY from_url, anchor_text, rel", g.RunID, int64(id))
+}
+
+func (g *LinkGraph) selectLinks(ctx context.Context, query string, args ...interface{}) ([]Link, error) {
+	db, err := g.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var rs []linkRecord
+	err = db.SelectContext(ctx, &rs, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	links := make([]Link, len(rs))
+	for i := range rs {
+		links[i] = rs[i].link()
+	}
+	return links, nil
+}
+
+// Orphans returns the request IDs of pages that were visited,
+// but that no other page links to.
+func (g *LinkGraph) Orphans() ([]uint64, error) {
+	return g.OrphansContext(context.Background())
+}
+
+// OrphansContext is like Orphans but includes a context.
+func (g *LinkGraph) OrphansContext(ctx context.Context) ([]uint64, error) {
+	db, err := g.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var rows []int64
+	err = db.SelectContext(ctx, &rows, `
+		SELECT v.id FROM visit v
+		WHERE v.run_id = ? AND NOT EXISTS (
+			SELECT 1 FROM link l WHERE l.run_id = v.run_id AND l.to_id = v.id AND l.from_id != v.id
+		)`, g.RunID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, len(rows))
+	for i, id := range rows {
+		ids[i] = uint64(id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// InDegrees returns, for each page that is linked to, the number of
+// other pages linking to it, in descending order of count.
+// At most limit counts are returned, or all if limit is not positive.
+func (g *LinkGraph) InDegrees(limit int) ([]LinkCount, error) {
+	return g.InDegreesContext(context.Background(), limit)
+}
+
+// InDegreesContext is like InDegrees but includes a context.
+func (g *LinkGraph) InDegreesContext(ctx context.Context, limit int) ([]LinkCount, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	db, err := g.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// IDs are ordered as unsigned, with those stored as negative last.
+	var rs []linkCountRecord
+	err = db.SelectContext(ctx, &rs, `
+		SELECT to_id, MIN(to_url) AS to_url, COUNT(DISTINCT from_id) AS count FROM link
+		WHERE run_id = ? AND from_id != to_id
+		GROUP BY to_id
+		ORDER BY count DESC, to_id < 0, to_id
+		LIMIT ?`, g.RunID, limit)
+	if err != nil {
+		return nil, err
+	}
+	counts := make([]LinkCount, len(rs))
+	for i, r := range rs {
+		counts[i] = r.LinkCount
+		counts[i].ID = uint64(r.ID)
+	}
+	return counts, nil
+}
+
+// eachLink calls fn with every link, in order of discovery.
+func (g *LinkGraph) eachLink(ctx context.Context, fn func(Link) error) error {
+	db, err := g.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rows, err := db.QueryxContext(ctx, "SELECT * FROM link WHERE run_id = ? ORDER BY rowid", g.RunID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r := linkRecord{}
+		err = rows.StructScan(&r)
+		if err != nil {
+			return err
+		}
+		err = fn(r.link())
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ExportCSV writes every link to w as CSV, with a header row.
+func (g *LinkGraph) ExportCSV(w io.Writer) error {
+	return g.ExportCSVContext(context.Background(), w)
+}
+
+// ExportCSVContext is like ExportCSV but includes a context.
+func (g *LinkGraph) ExportCSVContext(ctx context.Context, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write([]string{"from_url", "to_url", "anchor_text", "rel", "discovered_at"})
+	if err != nil {
+		return err
+	}
+	err = g.eachLink(ctx, func(l Link) error {
+		return cw.Write([]string{l.FromURL, l.ToURL, l.AnchorText, l.Rel, l.DiscoveredAt.Format(time.RFC3339)})
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportGraphML writes every link to w as a GraphML directed graph.
+// Nodes are identified by request ID and have a url attribute,
+// edges have anchor_text and rel attributes.
+func (g *LinkGraph) ExportGraphML(w io.Writer) error {
+	return g.ExportGraphMLContext(context.Background(), w)
+}
+
+// ExportGraphMLContext is like ExportGraphML but includes a context.
+func (g *LinkGraph) ExportGraphMLContext(ctx context.Context, w io.Writer) error {
+	_, err := io.WriteString(w, xml.Header+`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">
+  <key id="url" for="node" attr.name="url" attr.type="string"/>
+  <key id="anchor_text" for="edge" attr.name="anchor_text" attr.type="string"/>
+  <key id="rel" for="edge" attr.name="rel" attr.type="string"/>
+  <graph id="links" edgedefault="directed">
+`)
+	if err != nil {
+		return err
+	}
+	nodes := make(map[uint64]bool)
+	node := func(id uint64, u string) error {
+		if nodes[id] {
+			return nil
+		}
+		nodes[id] = true
+		_, err := fmt.Fprintf(w, "    <node id=\"n%d\"><data key=\"url\">%s</data></node>\n", id, escapeXML(u))
+		return err
+	}
+	err = g.eachLink(ctx, func(l Link) error {
+		err := node(l.FromID, l.FromURL)
+		if err != nil {
+			return err
+		}
+		err = node(l.ToID, l.ToURL)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "    <edge source=\"n%d\" target=\"n%d\"><data key=\"anchor_text\">%s</data><data key=\"rel\">%s</data></edge>\n",
+			l.FromID, l.ToID, escapeXML(l.AnchorText), escapeXML(l.Rel))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "  </graph>\n</graphml>\n")
+	return err
+}
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (g *LinkGraph) deleteRun(ctx context.Context, runID int64) error {
+	db, err := g.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM link WHERE run_id = ?", runID)
+	return err
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// The database is shared with a VisitTracker, whose visits are also copied.
+// It is safe to call while the link graph is in use.
+func (g *LinkGraph) Backup(destPath string, progress func(BackupProgress)) error {
+	return g.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (g *LinkGraph) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, g.Path, destPath, progress)
+}
+
+func (g *LinkGraph) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", g.Path)
+}
@@ -0,0 +1,156 @@
+package collysqlite_test
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LinkGraph", func() {
+
+	var path string
+	var t *collysqlite.VisitTracker
+	var g *collysqlite.LinkGraph
+
+	BeforeEach(func() {
+		path = "test-db-" + randomName()
+		t = collysqlite.NewVisitTracker(path)
+		g = collysqlite.NewLinkGraph(path)
+		Expect(t.Init()).To(BeNil())
+		Expect(g.Init()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(g.Destroy()).To(BeNil())
+		Expect(t.Destroy()).To(BeNil())
+		Expect(g.Path).NotTo(BeAnExistingFile())
+	})
+
+	links := []collysqlite.Link{
+		{FromID: 1, ToID: 2, FromURL: "http://a/", ToURL: "http://a/b", AnchorText: "B", Rel: ""},
+		{FromID: 1, ToID: 3, FromURL: "http://a/", ToURL: "http://a/c", AnchorText: "C & co", Rel: "nofollow"},
+		{FromID: 2, ToID: 3, FromURL: "http://a/b", ToURL: "http://a/c", AnchorText: "C", Rel: ""},
+		{FromID: 3, ToID: 3, FromURL: "http://a/c", ToURL: "http://a/c", AnchorText: "Top", Rel: ""},
+	}
+
+	It("should return inbound and outbound links", func() {
+		Expect(g.AddLinks(links)).To(BeNil())
+		// Duplicates are ignored.
+		Expect(g.AddLinks(links[:1])).To(BeNil())
+
+		out, err := g.Outlinks(1)
+		Expect(err).To(BeNil())
+		Expect(out).To(HaveLen(2))
+		Expect(out[0].ToURL).To(Equal("http://a/b"))
+		Expect(out[1].Rel).To(Equal("nofollow"))
+		Expect(out[1].DiscoveredAt).NotTo(BeZero())
+
+		in, err := g.Inlinks(3)
+		Expect(err).To(BeNil())
+		Expect(in).To(HaveLen(3))
+
+		in, err = g.Inlinks(1)
+		Expect(err).To(BeNil())
+		Expect(in).To(BeEmpty())
+	})
+
+	It("should count distinct inbound pages", func() {
+		Expect(g.AddLinks(links)).To(BeNil())
+		counts, err := g.InDegrees(0)
+		Expect(err).To(BeNil())
+		Expect(counts).To(Equal([]collysqlite.LinkCount{
+			{ID: 3, URL: "http://a/c", Count: 2},
+			{ID: 2, URL: "http://a/b", Count: 1},
+		}))
+		counts, err = g.InDegrees(1)
+		Expect(err).To(BeNil())
+		Expect(counts).To(HaveLen(1))
+	})
+
+	It("should find visited pages with no inbound links", func() {
+		Expect(g.AddLinks(links)).To(BeNil())
+		for _, id := range []uint64{1, 2, 3, 4} {
+			Expect(t.Visited(id)).To(BeNil())
+		}
+		orphans, err := g.Orphans()
+		Expect(err).To(BeNil())
+		Expect(orphans).To(Equal([]uint64{1, 4}))
+	})
+
+	It("should handle request IDs with the high bit set", func() {
+		const id = 1<<63 | 1
+		Expect(g.AddLinks([]collysqlite.Link{
+			{FromID: 1, ToID: id, FromURL: "http://a/", ToURL: "http://a/z"},
+			{FromID: id, ToID: 2, FromURL: "http://a/z", ToURL: "http://a/b"},
+		})).To(BeNil())
+		out, err := g.Outlinks(id)
+		Expect(err).To(BeNil())
+		Expect(out).To(HaveLen(1))
+		Expect(out[0].FromID).To(Equal(uint64(id)))
+		in, err := g.Inlinks(id)
+		Expect(err).To(BeNil())
+		Expect(in).To(HaveLen(1))
+		Expect(in[0].ToID).To(Equal(uint64(id)))
+		counts, err := g.InDegrees(0)
+		Expect(err).To(BeNil())
+		Expect(counts).To(Equal([]collysqlite.LinkCount{
+			{ID: 2, URL: "http://a/b", Count: 1},
+			{ID: id, URL: "http://a/z", Count: 1},
+		}))
+		for _, id := range []uint64{1, id} {
+			Expect(t.Visited(id)).To(BeNil())
+		}
+		orphans, err := g.Orphans()
+		Expect(err).To(BeNil())
+		Expect(orphans).To(Equal([]uint64{1}))
+	})
+
+	It("should keep runs separate", func() {
+		g.RunID = 1
+		Expect(g.AddLinks(links)).To(BeNil())
+		g.RunID = 2
+		out, err := g.Outlinks(1)
+		Expect(err).To(BeNil())
+		Expect(out).To(BeEmpty())
+	})
+
+	It("should export CSV", func() {
+		Expect(g.AddLinks(links)).To(BeNil())
+		var buf bytes.Buffer
+		Expect(g.ExportCSV(&buf)).To(BeNil())
+		records, err := csv.NewReader(&buf).ReadAll()
+		Expect(err).To(BeNil())
+		Expect(records).To(HaveLen(5))
+		Expect(records[0]).To(Equal([]string{"from_url", "to_url", "anchor_text", "rel", "discovered_at"}))
+		Expect(records[2][:4]).To(Equal([]string{"http://a/", "http://a/c", "C & co", "nofollow"}))
+	})
+
+	It("should export GraphML", func() {
+		Expect(g.AddLinks(links)).To(BeNil())
+		var buf bytes.Buffer
+		Expect(g.ExportGraphML(&buf)).To(BeNil())
+		var doc struct {
+			Nodes []struct {
+				ID   string `xml:"id,attr"`
+				Data string `xml:"data"`
+			} `xml:"graph>node"`
+			Edges []struct {
+				Source string   `xml:"source,attr"`
+				Target string   `xml:"target,attr"`
+				Data   []string `xml:"data"`
+			} `xml:"graph>edge"`
+		}
+		Expect(xml.Unmarshal(buf.Bytes(), &doc)).To(BeNil())
+		Expect(doc.Nodes).To(HaveLen(3))
+		Expect(doc.Nodes[2].Data).To(Equal("http://a/c"))
+		Expect(doc.Edges).To(HaveLen(4))
+		Expect(doc.Edges[1].Source).To(Equal("n1"))
+		Expect(doc.Edges[1].Target).To(Equal("n3"))
+		Expect(doc.Edges[1].Data).To(Equal([]string{"C & co", "nofollow"}))
+	})
+})
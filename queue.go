@@ -0,0 +1,328 @@
+package collysqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	createQueueDDL = `
+		CREATE TABLE IF NOT EXISTS queue (
+			id				INTEGER NOT NULL,
+			data			BLOB NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (id)
+		);
+	`
+	// lease_until is held as Unix nanoseconds, and is NULL when unleased.
+	addQueueLeaseDDL = `
+		ALTER TABLE queue ADD COLUMN lease_until INTEGER;
+		ALTER TABLE queue ADD COLUMN lease_token TEXT;
+		CREATE INDEX IF NOT EXISTS idx_queue_lease_until ON queue(lease_until);
+	`
+	dropQueueDDL = `
+		DROP INDEX IF EXISTS idx_queue_lease_until;
+		DROP TABLE IF EXISTS queue;
+	`
+)
+
+// queueMigrations are the steps that create and upgrade the queue schema.
+var queueMigrations = []migration{
+	execMigration(createQueueDDL),
+	execMigration(addQueueLeaseDDL),
+}
+
+// ErrQueueEmpty is returned by GetRequest and Lease when there are
+// no requests available.
+var ErrQueueEmpty = errors.New("collysqlite: queue is empty")
+
+// ErrLeaseExpired is returned by Ack and Release when a lease has expired,
+// and its request may have been leased to another consumer.
+var ErrLeaseExpired = errors.New("collysqlite: lease expired")
+
+type queueRecord struct {
+	ID        int64     `db:"id"`
+	Data      []byte    `db:"data"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// queueStorage is a local copy of colly's queue.Storage.
+type queueStorage interface {
+	// Init initializes the storage
+	Init() error
+	// AddRequest adds a serialized request to the queue
+	AddRequest([]byte) error
+	// GetRequest pops the next request from the queue
+	// or returns error if the queue is empty
+	GetRequest() ([]byte, error)
+	// QueueSize returns with the size of the queue
+	QueueSize() (int, error)
+}
+
+var _ queueStorage = &Queue{}
+
+// Queue is a persistent FIFO queue of serialised requests,
+// suitable for use as colly's queue.Storage.
+// Requests are removed atomically, so several consumers,
+// in one or more processes, may share a queue.
+//
+// Consumers that must not lose requests if they crash should use Lease
+// and Ack rather than GetRequest. A leased request is hidden from other
+// consumers until it is acked, or until its lease expires, when it is
+// available again. Consumers handling slow requests may Extend their leases.
+type Queue struct {
+	Path string
+}
+
+func NewQueue(path string) *Queue {
+	q := &Queue{
+		Path: path + ".sqlite",
+	}
+	return q
+}
+
+func (q *Queue) Init() error {
+	return q.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (q *Queue) InitContext(ctx context.Context) error {
+	err := ensurePathExists(q.Path)
+	if err != nil {
+		return err
+	}
+	db, err := q.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrate(ctx, db, "queue", queueMigrations)
+}
+
+func (q *Queue) Destroy() error {
+	return q.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (q *Queue) DestroyContext(ctx context.Context) error {
+	db, err := q.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, dropQueueDDL)
+	if err != nil {
+		return err
+	}
+	err = forgetSchema(ctx, db, "queue")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, q.Path)
+}
+
+// AddRequest adds a serialised request to the back of the queue.
+func (q *Queue) AddRequest(r []byte) error {
+	return q.AddRequestContext(context.Background(), r)
+}
+
+// AddRequestContext is like AddRequest but includes a context.
+func (q *Queue) AddRequestContext(ctx context.Context, r []byte) error {
+	db, err := q.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	rec := &queueRecord{
+		Data:      r,
+		CreatedAt: time.Now(),
+	}
+	_, err = db.NamedExecContext(ctx, "INSERT INTO queue (data, created_at) VALUES (:data, :created_at)", rec)
+	return err
+}
+
+// GetRequest removes and returns the first available request,
+// or returns ErrQueueEmpty if there are none.
+func (q *Queue) GetRequest() ([]byte, error) {
+	return q.GetRequestContext(context.Background())
+}
+
+// GetRequestContext is like GetRequest but includes a context.
+func (q *Queue) GetRequestContext(ctx context.Context) ([]byte, error) {
+	db, err := q.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var data []byte
+	err = db.GetContext(ctx, &data, `
+		DELETE FROM queue WHERE id = (
+			SELECT MIN(id) FROM queue WHERE lease_until IS NULL OR lease_until <= ?
+		) RETURNING data`, time.Now().UnixNano())
+	if err == sql.ErrNoRows {
+		return nil, ErrQueueEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// QueueSize returns the number of requests in the queue,
+// including those that are leased.
+func (q *Queue) QueueSize() (int, error) {
+	return q.QueueSizeContext(context.Background())
+}
+
+// QueueSizeContext is like QueueSize but includes a context.
+func (q *Queue) QueueSizeContext(ctx context.Context) (int, error) {
+	db, err := q.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var count int
+	err = db.GetContext(ctx, &count, "SELECT COUNT(*) FROM queue")
+	return count, err
+}
+
+// QueueLease is a request leased from a Queue.
+type QueueLease struct {
+	ID    int64  `db:"id"`
+	Token string `db:"lease_token"`
+	Data  []byte `db:"data"`
+	// Until is when the lease expires.
+	Until time.Time `db:"-"`
+}
+
+// Lease leases the first available request for the given duration,
+// or returns ErrQueueEmpty if there are none. The request remains in the
+// queue, hidden from other consumers, until it is acked or the lease expires.
+func (q *Queue) Lease(d time.Duration) (*QueueLease, error) {
+	return q.LeaseContext(context.Background(), d)
+}
+
+// LeaseContext is like Lease but includes a context.
+func (q *Queue) LeaseContext(ctx context.Context, d time.Duration) (*QueueLease, error) {
+	token, err := newLeaseToken()
+	if err != nil {
+		return nil, err
+	}
+	db, err := q.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	now := time.Now()
+	until := now.Add(d)
+	l := &QueueLease{}
+	err = db.GetContext(ctx, l, `
+		UPDATE queue SET lease_until = ?, lease_token = ?
+		WHERE id = (
+			SELECT MIN(id) FROM queue WHERE lease_until IS NULL OR lease_until <= ?
+		) RETURNING id, lease_token, data`, until.UnixNano(), token, now.UnixNano())
+	if err == sql.ErrNoRows {
+		return nil, ErrQueueEmpty
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.Until = until
+	return l, nil
+}
+
+// Ack removes a leased request from the queue, once it has been handled.
+// It returns ErrLeaseExpired if the lease has expired.
+func (q *Queue) Ack(l *QueueLease) error {
+	return q.AckContext(context.Background(), l)
+}
+
+// AckContext is like Ack but includes a context.
+func (q *Queue) AckContext(ctx context.Context, l *QueueLease) error {
+	return q.updateLease(ctx, l, "DELETE FROM queue WHERE id = ? AND lease_token = ? AND lease_until > ?")
+}
+
+// Release returns a leased request to the queue, unhandled,
+// making it available again immediately.
+// It returns ErrLeaseExpired if the lease has expired.
+func (q *Queue) Release(l *QueueLease) error {
+	return q.ReleaseContext(context.Background(), l)
+}
+
+// ReleaseContext is like Release but includes a context.
+func (q *Queue) ReleaseContext(ctx context.Context, l *QueueLease) error {
+	return q.updateLease(ctx, l, "UPDATE queue SET lease_until = NULL, lease_token = NULL WHERE id = ? AND lease_token = ? AND lease_until > ?")
+}
+
+// Extend extends a lease, so that it expires the given duration from now,
+// such as while a consumer is still handling a slow request.
+// It returns ErrLeaseExpired if the lease has already expired.
+func (q *Queue) Extend(l *QueueLease, d time.Duration) error {
+	return q.ExtendContext(context.Background(), l, d)
+}
+
+// ExtendContext is like Extend but includes a context.
+func (q *Queue) ExtendContext(ctx context.Context, l *QueueLease, d time.Duration) error {
+	until := time.Now().Add(d)
+	err := q.updateLease(ctx, l, "UPDATE queue SET lease_until = ? WHERE id = ? AND lease_token = ? AND lease_until > ?", until.UnixNano())
+	if err != nil {
+		return err
+	}
+	l.Until = until
+	return nil
+}
+
+// updateLease executes query with args followed by the lease's ID, token
+// and the current time. The query must only affect the request if the
+// lease is still held.
+func (q *Queue) updateLease(ctx context.Context, l *QueueLease, query string, args ...interface{}) error {
+	db, err := q.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	args = append(args, l.ID, l.Token, time.Now().UnixNano())
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the queue is in use.
+func (q *Queue) Backup(destPath string, progress func(BackupProgress)) error {
+	return q.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (q *Queue) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, q.Path, destPath, progress)
+}
+
+func (q *Queue) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", "file:"+q.Path+"?_busy_timeout="+busyTimeout)
+}
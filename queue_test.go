@@ -0,0 +1,195 @@
+package collysqlite_test
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+	"github.com/jmoiron/sqlx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Queue", func() {
+
+	It("should Init and Destroy", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		Expect(q.Init()).To(BeNil())
+		filename := name + ".sqlite"
+		Expect(filename).To(BeAnExistingFile())
+		Expect(q.Destroy()).To(BeNil())
+		Expect(filename).NotTo(BeAnExistingFile())
+	})
+
+	It("should be FIFO", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		Expect(q.Init()).To(BeNil())
+		defer q.Destroy()
+
+		_, err := q.GetRequest()
+		Expect(err).To(Equal(collysqlite.ErrQueueEmpty))
+		Expect(q.AddRequest([]byte("a"))).To(BeNil())
+		Expect(q.AddRequest([]byte("b"))).To(BeNil())
+		Expect(q.AddRequest([]byte("c"))).To(BeNil())
+		Expect(q.QueueSize()).To(Equal(3))
+
+		got, err := q.GetRequest()
+		Expect(err).To(BeNil())
+		Expect(string(got)).To(Equal("a"))
+		Expect(q.AddRequest([]byte("d"))).To(BeNil())
+		for _, want := range []string{"b", "c", "d"} {
+			got, err = q.GetRequest()
+			Expect(err).To(BeNil())
+			Expect(string(got)).To(Equal(want))
+		}
+		Expect(q.QueueSize()).To(Equal(0))
+		_, err = q.GetRequest()
+		Expect(err).To(Equal(collysqlite.ErrQueueEmpty))
+	})
+
+	It("should give each request to only one of several consumers", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		Expect(q.Init()).To(BeNil())
+		defer q.Destroy()
+
+		n := 100
+		for i := 0; i < n; i++ {
+			Expect(q.AddRequest([]byte(strconv.Itoa(i)))).To(BeNil())
+		}
+		var mu sync.Mutex
+		got := make(map[string]int)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for {
+					r, err := q.GetRequest()
+					if err == collysqlite.ErrQueueEmpty {
+						return
+					}
+					Expect(err).To(BeNil())
+					mu.Lock()
+					got[string(r)]++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		Expect(got).To(HaveLen(n))
+		for _, count := range got {
+			Expect(count).To(Equal(1))
+		}
+	})
+
+	It("should lease, ack and release", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		Expect(q.Init()).To(BeNil())
+		defer q.Destroy()
+		Expect(q.AddRequest([]byte("a"))).To(BeNil())
+		Expect(q.AddRequest([]byte("b"))).To(BeNil())
+
+		la, err := q.Lease(time.Minute)
+		Expect(err).To(BeNil())
+		Expect(string(la.Data)).To(Equal("a"))
+		// Leased requests are hidden, but counted.
+		got, err := q.GetRequest()
+		Expect(err).To(BeNil())
+		Expect(string(got)).To(Equal("b"))
+		_, err = q.Lease(time.Minute)
+		Expect(err).To(Equal(collysqlite.ErrQueueEmpty))
+		Expect(q.QueueSize()).To(Equal(1))
+
+		Expect(q.Release(la)).To(BeNil())
+		Expect(q.Release(la)).To(Equal(collysqlite.ErrLeaseExpired))
+		la, err = q.Lease(time.Minute)
+		Expect(err).To(BeNil())
+		Expect(string(la.Data)).To(Equal("a"))
+		Expect(q.Ack(la)).To(BeNil())
+		Expect(q.Ack(la)).To(Equal(collysqlite.ErrLeaseExpired))
+		Expect(q.QueueSize()).To(Equal(0))
+	})
+
+	It("should make a request available again when its lease expires", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		Expect(q.Init()).To(BeNil())
+		defer q.Destroy()
+		Expect(q.AddRequest([]byte("a"))).To(BeNil())
+
+		l1, err := q.Lease(50 * time.Millisecond)
+		Expect(err).To(BeNil())
+		_, err = q.Lease(time.Minute)
+		Expect(err).To(Equal(collysqlite.ErrQueueEmpty))
+		time.Sleep(time.Until(l1.Until))
+
+		l2, err := q.Lease(time.Minute)
+		Expect(err).To(BeNil())
+		Expect(string(l2.Data)).To(Equal("a"))
+		// The crashed consumer cannot ack, so the work is not duplicated.
+		Expect(q.Ack(l1)).To(Equal(collysqlite.ErrLeaseExpired))
+		Expect(q.Ack(l2)).To(BeNil())
+	})
+
+	It("should extend a lease", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		Expect(q.Init()).To(BeNil())
+		defer q.Destroy()
+		Expect(q.AddRequest([]byte("a"))).To(BeNil())
+
+		l, err := q.Lease(50 * time.Millisecond)
+		Expect(err).To(BeNil())
+		Expect(q.Extend(l, time.Minute)).To(BeNil())
+		Expect(l.Until).To(BeTemporally(">", time.Now().Add(time.Second)))
+		time.Sleep(100 * time.Millisecond)
+		_, err = q.Lease(time.Minute)
+		Expect(err).To(Equal(collysqlite.ErrQueueEmpty))
+		Expect(q.Ack(l)).To(BeNil())
+
+		// An expired lease cannot be extended.
+		Expect(q.AddRequest([]byte("b"))).To(BeNil())
+		l, err = q.Lease(time.Millisecond)
+		Expect(err).To(BeNil())
+		time.Sleep(10 * time.Millisecond)
+		Expect(q.Extend(l, time.Minute)).To(Equal(collysqlite.ErrLeaseExpired))
+	})
+
+	It("should migrate a queue created before leases", func() {
+		name := "test-db-" + randomName()
+		q := collysqlite.NewQueue(name)
+		db, err := sqlx.Connect("sqlite3", q.Path)
+		Expect(err).To(BeNil())
+		_, err = db.Exec(`
+			CREATE TABLE queue (
+				id				INTEGER NOT NULL,
+				data			BLOB NOT NULL,
+				created_at		DATETIME NOT NULL,
+				PRIMARY KEY (id)
+			);
+			CREATE TABLE schema_version (
+				name			TEXT NOT NULL,
+				version			INTEGER NOT NULL,
+				PRIMARY KEY (name)
+			);
+			INSERT INTO schema_version (name, version) VALUES ('queue', 1);
+			INSERT INTO queue (data, created_at) VALUES ('a', CURRENT_TIMESTAMP);
+		`)
+		Expect(err).To(BeNil())
+		db.Close()
+
+		Expect(q.Init()).To(BeNil())
+		defer q.Destroy()
+		l, err := q.Lease(time.Minute)
+		Expect(err).To(BeNil())
+		Expect(string(l.Data)).To(Equal("a"))
+		Expect(q.Ack(l)).To(BeNil())
+	})
+})
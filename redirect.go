@@ -0,0 +1,181 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// redirectMaxHops is the most redirects that are followed when resolving
+// a URL, guarding against loops.
+const redirectMaxHops = 20
+
+// ErrRedirectLoop is returned by ResolveRedirects when the recorded
+// redirects from a URL loop, or are more than redirectMaxHops long.
+var ErrRedirectLoop = errors.New("collysqlite: redirect loop")
+
+// RedirectHop is one response in a chain of redirects.
+type RedirectHop struct {
+	URL        string `db:"url"`
+	StatusCode int    `db:"status_code"`
+	// Location is the Location header of the response, as given.
+	Location string `db:"location"`
+}
+
+type redirectRecord struct {
+	RedirectHop
+	OriginURL string    `db:"origin_url"`
+	Hop       int       `db:"hop"`
+	TargetURL string    `db:"target_url"`
+	RunID     int64     `db:"run_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// PutRedirects records the chain of redirects followed for a request
+// to originURL, whose first hop must be originURL itself. Each hop must
+// have a 3xx status code and a Location, which each following hop must
+// be the URL of. The response at the end of the
+// chain should be cached with Put under its own URL, after which Get
+// resolves any URL of the chain to it.
+// Any chain already recorded for originURL is replaced.
+// Redirects are recorded for the Cache's RunID, and are read as cached
+// data is, see ScopeReadsToRun.
+func (c *Cache) PutRedirects(originURL string, hops []RedirectHop) error {
+	return c.PutRedirectsContext(context.Background(), originURL, hops)
+}
+
+// PutRedirectsContext is like PutRedirects but includes a context.
+func (c *Cache) PutRedirectsContext(ctx context.Context, originURL string, hops []RedirectHop) error {
+	if len(hops) > 0 && hops[0].URL != originURL {
+		return fmt.Errorf("collysqlite: first redirect is of %s, not %s", hops[0].URL, originURL)
+	}
+	now := time.Now()
+	rs := make([]redirectRecord, len(hops))
+	for i, h := range hops {
+		if h.StatusCode < 300 || h.StatusCode >= 400 {
+			return fmt.Errorf("collysqlite: status %d of %s is not a redirect", h.StatusCode, h.URL)
+		}
+		if h.Location == "" {
+			return fmt.Errorf("collysqlite: redirect of %s has no Location", h.URL)
+		}
+		base, err := url.Parse(h.URL)
+		if err != nil {
+			return err
+		}
+		loc, err := url.Parse(h.Location)
+		if err != nil {
+			return fmt.Errorf("collysqlite: invalid Location %q of %s: %w", h.Location, h.URL, err)
+		}
+		rs[i] = redirectRecord{
+			RedirectHop: h,
+			OriginURL:   originURL,
+			Hop:         i,
+			TargetURL:   base.ResolveReference(loc).String(),
+			RunID:       c.RunID,
+			CreatedAt:   now,
+		}
+		if i > 0 && h.URL != rs[i-1].TargetURL {
+			return fmt.Errorf("collysqlite: redirect of %s is to %s, not %s", hops[i-1].URL, rs[i-1].TargetURL, h.URL)
+		}
+	}
+	db, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, "DELETE FROM redirect WHERE run_id = ? AND origin_url = ?", c.RunID, originURL)
+	if err != nil {
+		return err
+	}
+	for i := range rs {
+		_, err = tx.NamedExecContext(ctx, `
+			INSERT OR REPLACE INTO redirect (run_id, url, origin_url, hop, status_code, location, target_url, created_at)
+			VALUES (:run_id, :url, :origin_url, :hop, :status_code, :location, :target_url, :created_at)`, &rs[i])
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Redirects returns the chain of redirects recorded for a request to
+// originURL, or nil if there is none. Hops since recorded as part of
+// another chain are not included. Unless ScopeReadsToRun is set, the
+// chain recorded most recently, by any run, is returned.
+func (c *Cache) Redirects(originURL string) ([]RedirectHop, error) {
+	return c.RedirectsContext(context.Background(), originURL)
+}
+
+// RedirectsContext is like Redirects but includes a context.
+func (c *Cache) RedirectsContext(ctx context.Context, originURL string) ([]RedirectHop, error) {
+	db, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var runID int64
+	err = db.GetContext(ctx, &runID, `
+		SELECT run_id FROM redirect WHERE (? OR run_id = ?) AND origin_url = ?
+		ORDER BY created_at DESC LIMIT 1`, !c.ScopeReadsToRun, c.RunID, originURL)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var hops []RedirectHop
+	err = db.SelectContext(ctx, &hops, "SELECT url, status_code, location FROM redirect WHERE run_id = ? AND origin_url = ? ORDER BY hop", runID, originURL)
+	return hops, err
+}
+
+// ResolveRedirects returns the URL that rawURL finally redirects to,
+// following recorded redirects, or rawURL if it does not redirect.
+// It returns ErrRedirectLoop if the redirects do not end.
+func (c *Cache) ResolveRedirects(rawURL string) (string, error) {
+	return c.ResolveRedirectsContext(context.Background(), rawURL)
+}
+
+// ResolveRedirectsContext is like ResolveRedirects but includes a context.
+func (c *Cache) ResolveRedirectsContext(ctx context.Context, rawURL string) (string, error) {
+	db, err := c.connect(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	return c.resolveRedirects(ctx, db, rawURL)
+}
+
+// resolveRedirects follows the redirects that c reads from rawURL,
+// returning ErrRedirectLoop if they revisit a URL, or do not end
+// within redirectMaxHops.
+func (c *Cache) resolveRedirects(ctx context.Context, db *sqlx.DB, rawURL string) (string, error) {
+	seen := map[string]bool{rawURL: true}
+	u := rawURL
+	for i := 0; ; i++ {
+		var target string
+		err := db.GetContext(ctx, &target, `
+			SELECT target_url FROM redirect WHERE (? OR run_id = ?) AND url = ?
+			ORDER BY created_at DESC LIMIT 1`, !c.ScopeReadsToRun, c.RunID, u)
+		if err == sql.ErrNoRows {
+			return u, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if seen[target] || i == redirectMaxHops {
+			return "", ErrRedirectLoop
+		}
+		seen[target] = true
+		u = target
+	}
+}
@@ -0,0 +1,161 @@
+package collysqlite_test
+
+import (
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cache redirects", func() {
+
+	var c *collysqlite.Cache
+
+	BeforeEach(func() {
+		c = collysqlite.NewCache("test-db-" + randomName())
+		Expect(c.Init()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(c.Destroy()).To(BeNil())
+		Expect(c.Path).NotTo(BeAnExistingFile())
+	})
+
+	hops := []collysqlite.RedirectHop{
+		{URL: "http://example.org/a", StatusCode: 301, Location: "https://example.org/a"},
+		{URL: "https://example.org/a", StatusCode: 302, Location: "/b"},
+	}
+
+	It("should record the chain of a request", func() {
+		Expect(c.PutRedirects("http://example.org/a", hops)).To(BeNil())
+		got, err := c.Redirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal(hops))
+
+		got, err = c.Redirects("https://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(BeEmpty())
+
+		// Recording again replaces the chain.
+		Expect(c.PutRedirects("http://example.org/a", hops[:1])).To(BeNil())
+		got, err = c.Redirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal(hops[:1]))
+	})
+
+	It("should resolve any URL of a chain to the final response", func() {
+		Expect(c.PutRedirects("http://example.org/a", hops)).To(BeNil())
+		data := []byte("final")
+		Expect(c.Put("https://example.org/b", data)).To(BeNil())
+
+		for _, u := range []string{"http://example.org/a", "https://example.org/a", "https://example.org/b"} {
+			final, err := c.ResolveRedirects(u)
+			Expect(err).To(BeNil())
+			Expect(final).To(Equal("https://example.org/b"))
+			got, err := c.Get(u)
+			Expect(err).To(BeNil())
+			Expect(got).To(Equal(data))
+		}
+
+		final, err := c.ResolveRedirects("http://example.org/other")
+		Expect(err).To(BeNil())
+		Expect(final).To(Equal("http://example.org/other"))
+	})
+
+	It("should prefer the data cached for the URL itself", func() {
+		Expect(c.PutRedirects("http://example.org/a", hops)).To(BeNil())
+		Expect(c.Put("https://example.org/b", []byte("final"))).To(BeNil())
+		data := []byte("original")
+		Expect(c.Put("http://example.org/a", data)).To(BeNil())
+		got, err := c.Get("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal(data))
+	})
+
+	It("should remove the redirects recorded from a URL", func() {
+		Expect(c.PutRedirects("http://example.org/a", hops)).To(BeNil())
+		Expect(c.Put("https://example.org/b", []byte("final"))).To(BeNil())
+		Expect(c.Remove("http://example.org/a")).To(BeNil())
+		got, err := c.Get("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+		final, err := c.ResolveRedirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(final).To(Equal("http://example.org/a"))
+		// Other URLs of the chain still redirect.
+		got, err = c.Get("https://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal([]byte("final")))
+	})
+
+	It("should detect redirect loops", func() {
+		loop := []collysqlite.RedirectHop{
+			{URL: "http://example.org/x", StatusCode: 302, Location: "/y"},
+			{URL: "http://example.org/y", StatusCode: 302, Location: "/x"},
+		}
+		Expect(c.PutRedirects("http://example.org/x", loop)).To(BeNil())
+		_, err := c.ResolveRedirects("http://example.org/x")
+		Expect(err).To(Equal(collysqlite.ErrRedirectLoop))
+		got, err := c.Get("http://example.org/x")
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+
+		// Get falls back to the URL itself.
+		Expect(c.Put("http://example.org/x", []byte("x"))).To(BeNil())
+		got, err = c.Get("http://example.org/x")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal([]byte("x")))
+	})
+
+	It("should reject invalid chains", func() {
+		Expect(c.PutRedirects("http://example.org/other", hops)).NotTo(BeNil())
+		Expect(c.PutRedirects("http://example.org/a", []collysqlite.RedirectHop{
+			{URL: "http://example.org/a", StatusCode: 200, Location: "/b"},
+		})).NotTo(BeNil())
+		Expect(c.PutRedirects("http://example.org/a", []collysqlite.RedirectHop{
+			{URL: "http://example.org/a", StatusCode: 301},
+		})).NotTo(BeNil())
+		// Each hop must be the URL that the one before redirects to.
+		err := c.PutRedirects("http://example.org/a", []collysqlite.RedirectHop{
+			{URL: "http://example.org/a", StatusCode: 301, Location: "https://example.org/a"},
+			{URL: "https://example.org/c", StatusCode: 302, Location: "/b"},
+		})
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("is to https://example.org/a, not https://example.org/c"))
+		got, err := c.Redirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(BeEmpty())
+	})
+
+	It("should keep each run's redirects separate", func() {
+		c.ScopeReadsToRun = true
+		c.RunID = 1
+		Expect(c.PutRedirects("http://example.org/a", hops)).To(BeNil())
+		c.RunID = 2
+		final, err := c.ResolveRedirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(final).To(Equal("http://example.org/a"))
+		got, err := c.Redirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(BeEmpty())
+		Expect(c.PutRedirects("http://example.org/a", hops[:1])).To(BeNil())
+
+		c.RunID = 1
+		got, err = c.Redirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal(hops))
+		final, err = c.ResolveRedirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(final).To(Equal("https://example.org/b"))
+
+		// Unscoped reads see the latest chain of any run,
+		// and follow the latest redirect of each URL.
+		c.ScopeReadsToRun = false
+		got, err = c.Redirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(got).To(Equal(hops[:1]))
+		final, err = c.ResolveRedirects("http://example.org/a")
+		Expect(err).To(BeNil())
+		Expect(final).To(Equal("https://example.org/b"))
+	})
+})
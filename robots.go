@@ -0,0 +1,282 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	createRobotsDDL = `
+		CREATE TABLE IF NOT EXISTS robots (
+			key				TEXT NOT NULL,
+			status_code		INTEGER NOT NULL,
+			body			BLOB,
+			fetched_at		DATETIME NOT NULL,
+			expires_at		DATETIME NOT NULL,
+			PRIMARY KEY (key)
+		);
+	`
+	dropRobotsDDL = `
+		DROP TABLE IF EXISTS robots;
+	`
+)
+
+// robotsMigrations are the steps that create and upgrade the robots schema.
+var robotsMigrations = []migration{
+	execMigration(createRobotsDDL),
+}
+
+// RobotsMaxAge is how long robots.txt files are kept by default,
+// following the guidance of RFC 9309 section 2.4.
+const RobotsMaxAge = 24 * time.Hour
+
+// RobotsErrorMaxAge is how long responses showing a site to be
+// unreachable are kept by default, so that they are soon retried.
+const RobotsErrorMaxAge = 10 * time.Minute
+
+// RobotsPolicy is how a crawler should treat a site,
+// given the response to its robots.txt request.
+type RobotsPolicy int
+
+const (
+	// RobotsFollow means the rules in the body should be followed.
+	RobotsFollow RobotsPolicy = iota
+	// RobotsAllowAll means the robots.txt file is unavailable, such as
+	// with a 4xx status, and any resource may be crawled.
+	RobotsAllowAll
+	// RobotsDisallowAll means the robots.txt file is unreachable, such as
+	// with a 5xx status or a network error, and nothing may be crawled.
+	RobotsDisallowAll
+)
+
+// Robots is a stored response to a robots.txt request.
+type Robots struct {
+	// Key is the scheme and host of the site, such as "https://example.org".
+	Key string `db:"key"`
+	// StatusCode is zero if there was no response, such as a network error.
+	StatusCode int       `db:"status_code"`
+	Body       []byte    `db:"body"`
+	FetchedAt  time.Time `db:"fetched_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+// Policy returns how the site should be treated, following RFC 9309
+// section 2.3.1. Redirects should have been followed by the fetcher,
+// a 3xx status means there were too many, and is treated as unavailable.
+// A 1xx status, which is not a final response, and a status of zero,
+// meaning there was no response, are treated as unreachable,
+// as are 5xx statuses.
+func (r *Robots) Policy() RobotsPolicy {
+	switch {
+	case r.StatusCode >= 200 && r.StatusCode < 300:
+		return RobotsFollow
+	case r.StatusCode >= 300 && r.StatusCode < 500:
+		return RobotsAllowAll
+	default:
+		return RobotsDisallowAll
+	}
+}
+
+// RobotsStore keeps robots.txt files, keyed by scheme and host,
+// so that they need not be fetched again by every collector.
+type RobotsStore struct {
+	Path string
+	// MaxAge is how long a robots.txt file is kept, zero means RobotsMaxAge.
+	MaxAge time.Duration
+	// ErrorMaxAge is how long a response showing the site to be
+	// unreachable is kept, zero means RobotsErrorMaxAge.
+	ErrorMaxAge time.Duration
+}
+
+func NewRobotsStore(path string) *RobotsStore {
+	r := &RobotsStore{
+		Path: path + ".sqlite",
+	}
+	return r
+}
+
+func (r *RobotsStore) Init() error {
+	return r.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (r *RobotsStore) InitContext(ctx context.Context) error {
+	err := ensurePathExists(r.Path)
+	if err != nil {
+		return err
+	}
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrate(ctx, db, "robots", robotsMigrations)
+}
+
+func (r *RobotsStore) Destroy() error {
+	return r.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (r *RobotsStore) DestroyContext(ctx context.Context) error {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, dropRobotsDDL)
+	if err != nil {
+		return err
+	}
+	err = forgetSchema(ctx, db, "robots")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, r.Path)
+}
+
+// Robots returns the robots.txt response for the site of u,
+// or nil if there is none or it has expired.
+func (r *RobotsStore) Robots(u *url.URL) (*Robots, error) {
+	return r.RobotsContext(context.Background(), u)
+}
+
+// RobotsContext is like Robots but includes a context.
+func (r *RobotsStore) RobotsContext(ctx context.Context, u *url.URL) (*Robots, error) {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rec := &Robots{}
+	err = db.GetContext(ctx, rec, "SELECT * FROM robots WHERE key = ?", robotsKey(u))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(rec.ExpiresAt) {
+		return nil, nil
+	}
+	return rec, nil
+}
+
+// PutRobots stores the response to a robots.txt request for the site of u,
+// with the given status code, which is zero if there was no response.
+// It returns the record that is kept.
+//
+// Responses showing the site to be unreachable are kept for ErrorMaxAge.
+// They do not replace a stored 2xx response: while it is unexpired it is
+// kept as it is, and once expired it continues to be served, for a further
+// ErrorMaxAge, as RFC 9309 section 2.4 permits.
+func (r *RobotsStore) PutRobots(u *url.URL, statusCode int, body []byte) (*Robots, error) {
+	return r.PutRobotsContext(context.Background(), u, statusCode, body)
+}
+
+// PutRobotsContext is like PutRobots but includes a context.
+func (r *RobotsStore) PutRobotsContext(ctx context.Context, u *url.URL, statusCode int, body []byte) (*Robots, error) {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	rec := &Robots{
+		Key:        robotsKey(u),
+		StatusCode: statusCode,
+		Body:       body,
+		FetchedAt:  now,
+		ExpiresAt:  now.Add(r.maxAge()),
+	}
+	if rec.Policy() == RobotsDisallowAll {
+		rec.ExpiresAt = now.Add(r.errorMaxAge())
+		old := &Robots{}
+		err = tx.GetContext(ctx, old, "SELECT * FROM robots WHERE key = ?", rec.Key)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if err == nil && old.Policy() == RobotsFollow {
+			if now.Before(old.ExpiresAt) {
+				return old, nil
+			}
+			// Serve the stale copy until the site can be reached.
+			old.ExpiresAt = rec.ExpiresAt
+			rec = old
+		}
+	}
+	_, err = tx.NamedExecContext(ctx, `
+		INSERT OR REPLACE INTO robots (key, status_code, body, fetched_at, expires_at)
+		VALUES (:key, :status_code, :body, :fetched_at, :expires_at)`, rec)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (r *RobotsStore) maxAge() time.Duration {
+	if r.MaxAge == 0 {
+		return RobotsMaxAge
+	}
+	return r.MaxAge
+}
+
+func (r *RobotsStore) errorMaxAge() time.Duration {
+	if r.ErrorMaxAge == 0 {
+		return RobotsErrorMaxAge
+	}
+	return r.ErrorMaxAge
+}
+
+// RemoveRobots removes the robots.txt response for the site of u.
+func (r *RobotsStore) RemoveRobots(u *url.URL) error {
+	return r.RemoveRobotsContext(context.Background(), u)
+}
+
+// RemoveRobotsContext is like RemoveRobots but includes a context.
+func (r *RobotsStore) RemoveRobotsContext(ctx context.Context, u *url.URL) error {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM robots WHERE key = ?", robotsKey(u))
+	return err
+}
+
+// robotsKey returns the key of the site of u: its scheme and host.
+func robotsKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host)
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the store is in use.
+func (r *RobotsStore) Backup(destPath string, progress func(BackupProgress)) error {
+	return r.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (r *RobotsStore) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, r.Path, destPath, progress)
+}
+
+// connect begins transactions immediately, so that concurrent
+// puts of the same site do not fail to upgrade their locks.
+func (r *RobotsStore) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", "file:"+r.Path+"?_busy_timeout="+busyTimeout+"&_txlock=immediate")
+}
@@ -0,0 +1,122 @@
+package collysqlite_test
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("RobotsStore", func() {
+
+	var r *collysqlite.RobotsStore
+
+	BeforeEach(func() {
+		r = collysqlite.NewRobotsStore("test-db-" + randomName())
+		Expect(r.Init()).To(BeNil())
+	})
+
+	AfterEach(func() {
+		Expect(r.Destroy()).To(BeNil())
+		Expect(r.Path).NotTo(BeAnExistingFile())
+	})
+
+	It("should store robots.txt by scheme and host", func() {
+		u, _ := url.Parse("https://Example.org/some/page")
+		body := []byte("User-agent: *\nDisallow: /private\n")
+		_, err := r.PutRobots(u, 200, body)
+		Expect(err).To(BeNil())
+
+		u2, _ := url.Parse("https://example.org/robots.txt")
+		got, err := r.Robots(u2)
+		Expect(err).To(BeNil())
+		Expect(got.Key).To(Equal("https://example.org"))
+		Expect(got.Body).To(Equal(body))
+		Expect(got.Policy()).To(Equal(collysqlite.RobotsFollow))
+		Expect(got.ExpiresAt).To(BeTemporally("~", got.FetchedAt.Add(collysqlite.RobotsMaxAge), time.Second))
+
+		u3, _ := url.Parse("http://example.org/")
+		got, err = r.Robots(u3)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+
+		Expect(r.RemoveRobots(u)).To(BeNil())
+		got, err = r.Robots(u)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+	})
+
+	It("should expire robots.txt", func() {
+		r.MaxAge = 50 * time.Millisecond
+		u, _ := url.Parse("https://example.org/")
+		_, err := r.PutRobots(u, 200, nil)
+		Expect(err).To(BeNil())
+		Expect(r.Robots(u)).NotTo(BeNil())
+		time.Sleep(r.MaxAge)
+		Expect(r.Robots(u)).To(BeNil())
+	})
+
+	It("should distinguish unavailable from unreachable", func() {
+		for status, policy := range map[int]collysqlite.RobotsPolicy{
+			200: collysqlite.RobotsFollow,
+			301: collysqlite.RobotsAllowAll,
+			404: collysqlite.RobotsAllowAll,
+			429: collysqlite.RobotsAllowAll,
+			500: collysqlite.RobotsDisallowAll,
+			503: collysqlite.RobotsDisallowAll,
+			0:   collysqlite.RobotsDisallowAll,
+			100: collysqlite.RobotsDisallowAll,
+		} {
+			rb := &collysqlite.Robots{StatusCode: status}
+			Expect(rb.Policy()).To(Equal(policy), "status %d", status)
+		}
+	})
+
+	It("should keep unreachable responses briefly", func() {
+		u, _ := url.Parse("https://example.org/")
+		got, err := r.PutRobots(u, 503, nil)
+		Expect(err).To(BeNil())
+		Expect(got.ExpiresAt).To(BeTemporally("~", got.FetchedAt.Add(collysqlite.RobotsErrorMaxAge), time.Second))
+		got, err = r.PutRobots(u, 0, nil)
+		Expect(err).To(BeNil())
+		Expect(got.StatusCode).To(Equal(0))
+
+		// A good response replaces an unreachable one.
+		got, err = r.PutRobots(u, 200, []byte("User-agent: *\n"))
+		Expect(err).To(BeNil())
+		Expect(got.StatusCode).To(Equal(200))
+	})
+
+	It("should keep a good response while the site is unreachable", func() {
+		r.MaxAge = 50 * time.Millisecond
+		r.ErrorMaxAge = time.Minute
+		u, _ := url.Parse("https://example.org/")
+		body := []byte("User-agent: *\nDisallow: /private\n")
+		good, err := r.PutRobots(u, 200, body)
+		Expect(err).To(BeNil())
+
+		// An unexpired good response is not replaced.
+		got, err := r.PutRobots(u, 500, nil)
+		Expect(err).To(BeNil())
+		Expect(got.StatusCode).To(Equal(200))
+		got, err = r.Robots(u)
+		Expect(err).To(BeNil())
+		Expect(got.StatusCode).To(Equal(200))
+		Expect(got.ExpiresAt).To(BeTemporally("==", good.ExpiresAt))
+
+		// An expired one is served for a further ErrorMaxAge.
+		time.Sleep(r.MaxAge)
+		Expect(r.Robots(u)).To(BeNil())
+		got, err = r.PutRobots(u, 0, nil)
+		Expect(err).To(BeNil())
+		Expect(got.StatusCode).To(Equal(200))
+		got, err = r.Robots(u)
+		Expect(err).To(BeNil())
+		Expect(got.Body).To(Equal(body))
+		Expect(got.FetchedAt).To(BeTemporally("==", good.FetchedAt))
+		Expect(got.ExpiresAt).To(BeTemporally("~", time.Now().Add(r.ErrorMaxAge), time.Second))
+	})
+})
@@ -0,0 +1,277 @@
+package collysqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// AUTOINCREMENT, so that the IDs of deleted runs are never reused.
+	createRunDDL = `
+		CREATE TABLE IF NOT EXISTS run (
+			id				INTEGER PRIMARY KEY AUTOINCREMENT,
+			name			TEXT NOT NULL,
+			status			TEXT NOT NULL,
+			config			TEXT NOT NULL,
+			started_at		DATETIME NOT NULL,
+			ended_at		DATETIME
+		);
+		CREATE INDEX IF NOT EXISTS idx_run_started_at ON run(started_at);
+	`
+	dropRunDDL = `
+		DROP INDEX IF EXISTS idx_run_started_at;
+		DROP TABLE IF EXISTS run;
+	`
+)
+
+// runMigrations are the steps that create and upgrade the run schema.
+var runMigrations = []migration{
+	execMigration(createRunDDL),
+}
+
+// RunStatus is the state of a Run.
+type RunStatus string
+
+const (
+	RunRunning   RunStatus = "running"
+	RunCompleted RunStatus = "completed"
+	RunFailed    RunStatus = "failed"
+	RunAborted   RunStatus = "aborted"
+)
+
+// Run is a crawl session. Visits, frontier requests, failures and cache
+// writes can be tagged with a run, by setting their RunID, so that runs
+// can be compared, resumed or deleted independently.
+type Run struct {
+	ID     int64     `db:"id"`
+	Name   string    `db:"name"`
+	Status RunStatus `db:"status"`
+	// Config is the crawl's configuration, as JSON.
+	Config    string     `db:"config"`
+	StartedAt time.Time  `db:"started_at"`
+	EndedAt   *time.Time `db:"ended_at"`
+}
+
+// Runs records crawl sessions.
+type Runs struct {
+	Path string
+}
+
+func NewRuns(path string) *Runs {
+	r := &Runs{
+		Path: path + ".sqlite",
+	}
+	return r
+}
+
+func (r *Runs) Init() error {
+	return r.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (r *Runs) InitContext(ctx context.Context) error {
+	err := ensurePathExists(r.Path)
+	if err != nil {
+		return err
+	}
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrate(ctx, db, "run", runMigrations)
+}
+
+func (r *Runs) Destroy() error {
+	return r.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (r *Runs) DestroyContext(ctx context.Context) error {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, dropRunDDL)
+	if err != nil {
+		return err
+	}
+	err = forgetSchema(ctx, db, "run")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, r.Path)
+}
+
+// StartRun records the start of a new run, with the given name and
+// config, which is stored as JSON.
+func (r *Runs) StartRun(name string, config interface{}) (*Run, error) {
+	return r.StartRunContext(context.Background(), name, config)
+}
+
+// StartRunContext is like StartRun but includes a context.
+func (r *Runs) StartRunContext(ctx context.Context, name string, config interface{}) (*Run, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	db, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	run := &Run{
+		Name:      name,
+		Status:    RunRunning,
+		Config:    string(b),
+		StartedAt: time.Now(),
+	}
+	res, err := db.NamedExecContext(ctx, "INSERT INTO run (name, status, config, started_at) VALUES (:name, :status, :config, :started_at)", run)
+	if err != nil {
+		return nil, err
+	}
+	run.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// EndRun records the end of the run with the given ID, and its final status.
+func (r *Runs) EndRun(id int64, status RunStatus) error {
+	return r.EndRunContext(context.Background(), id, status)
+}
+
+// EndRunContext is like EndRun but includes a context.
+func (r *Runs) EndRunContext(ctx context.Context, id int64, status RunStatus) error {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "UPDATE run SET status = ?, ended_at = ? WHERE id = ?", status, time.Now(), id)
+	return err
+}
+
+// Run returns the run with the given ID, or nil if there is none.
+func (r *Runs) Run(id int64) (*Run, error) {
+	return r.RunContext(context.Background(), id)
+}
+
+// RunContext is like Run but includes a context.
+func (r *Runs) RunContext(ctx context.Context, id int64) (*Run, error) {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	run := &Run{}
+	err = db.GetContext(ctx, run, "SELECT * FROM run WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// ListRuns returns all runs, in the order they were started.
+func (r *Runs) ListRuns() ([]Run, error) {
+	return r.ListRunsContext(context.Background())
+}
+
+// ListRunsContext is like ListRuns but includes a context.
+func (r *Runs) ListRunsContext(ctx context.Context) ([]Run, error) {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var runs []Run
+	err = db.SelectContext(ctx, &runs, "SELECT * FROM run ORDER BY id")
+	return runs, err
+}
+
+// DeleteRun removes the record of the run with the given ID.
+// See Storage.DeleteRun to also remove the run's data.
+func (r *Runs) DeleteRun(id int64) error {
+	return r.DeleteRunContext(context.Background(), id)
+}
+
+// DeleteRunContext is like DeleteRun but includes a context.
+func (r *Runs) DeleteRunContext(ctx context.Context, id int64) error {
+	db, err := r.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM run WHERE id = ?", id)
+	return err
+}
+
+// StartRun records the start of a new run, and makes it the current run,
+// whose visits, frontier requests, failures and cache writes are tagged with its ID.
+func (s *Storage) StartRun(name string, config interface{}) (*Run, error) {
+	return s.StartRunContext(context.Background(), name, config)
+}
+
+// StartRunContext is like StartRun but includes a context.
+func (s *Storage) StartRunContext(ctx context.Context, name string, config interface{}) (*Run, error) {
+	run, err := s.Runs.StartRunContext(ctx, name, config)
+	if err != nil {
+		return nil, err
+	}
+	s.UseRun(run.ID)
+	return run, nil
+}
+
+// UseRun makes the run with the given ID the current run, such as to
+// resume it. Zero means no run, as when runs are not used.
+// It should not be called while the storage is in use.
+func (s *Storage) UseRun(id int64) {
+	s.VisitTracker.RunID = id
+	s.Frontier.RunID = id
+	s.LinkGraph.RunID = id
+	s.Cache.RunID = id
+	s.Failures.RunID = id
+}
+
+// DeleteRun removes the run with the given ID, and its visits, frontier,
+// links, failures and cache entries, returning a MultiError of any failures.
+func (s *Storage) DeleteRun(id int64) error {
+	return s.DeleteRunContext(context.Background(), id)
+}
+
+// DeleteRunContext is like DeleteRun but includes a context.
+func (s *Storage) DeleteRunContext(ctx context.Context, id int64) error {
+	return newMultiError([]error{
+		s.VisitTracker.deleteRun(ctx, id),
+		s.Frontier.deleteRun(ctx, id),
+		s.LinkGraph.deleteRun(ctx, id),
+		s.Cache.deleteRun(ctx, id),
+		s.Failures.deleteRun(ctx, id),
+		s.Runs.DeleteRunContext(ctx, id),
+	})
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the store is in use.
+func (r *Runs) Backup(destPath string, progress func(BackupProgress)) error {
+	return r.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (r *Runs) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, r.Path, destPath, progress)
+}
+
+func (r *Runs) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", r.Path)
+}
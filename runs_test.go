@@ -0,0 +1,135 @@
+package collysqlite_test
+
+import (
+	"errors"
+
+	"github.com/jimsmart/collysqlite"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Runs", func() {
+
+	It("should start, end and list runs", func() {
+		r := collysqlite.NewRuns("test-db-" + randomName())
+		Expect(r.Init()).To(BeNil())
+		defer r.Destroy()
+
+		config := map[string]interface{}{"depth": 2}
+		run1, err := r.StartRun("first", config)
+		Expect(err).To(BeNil())
+		Expect(run1.Status).To(Equal(collysqlite.RunRunning))
+		run2, err := r.StartRun("second", nil)
+		Expect(err).To(BeNil())
+		Expect(run2.ID).To(BeNumerically(">", run1.ID))
+
+		Expect(r.EndRun(run1.ID, collysqlite.RunCompleted)).To(BeNil())
+		got, err := r.Run(run1.ID)
+		Expect(err).To(BeNil())
+		Expect(got.Name).To(Equal("first"))
+		Expect(got.Status).To(Equal(collysqlite.RunCompleted))
+		Expect(got.Config).To(MatchJSON(`{"depth": 2}`))
+		Expect(got.EndedAt).NotTo(BeNil())
+
+		runs, err := r.ListRuns()
+		Expect(err).To(BeNil())
+		Expect(runs).To(HaveLen(2))
+		Expect(runs[1].Name).To(Equal("second"))
+		Expect(runs[1].EndedAt).To(BeNil())
+
+		Expect(r.DeleteRun(run2.ID)).To(BeNil())
+		got, err = r.Run(run2.ID)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeNil())
+	})
+
+	It("should keep each run's data separate", func() {
+		s := collysqlite.NewStorage("test-db-" + randomName())
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+
+		run1, err := s.StartRun("first", nil)
+		Expect(err).To(BeNil())
+		Expect(s.Visited(1)).To(BeNil())
+		Expect(s.Visited(2)).To(BeNil())
+		Expect(s.Put("http://example.org/1", []byte{1})).To(BeNil())
+		_, err = s.Failed("http://example.org/3", 0, errors.New("connection refused"))
+		Expect(err).To(BeNil())
+
+		run2, err := s.StartRun("second", nil)
+		Expect(err).To(BeNil())
+		Expect(s.IsVisited(1)).To(BeFalse())
+		Expect(s.Visited(1)).To(BeNil())
+		Expect(s.RunVisits(run1.ID)).To(Equal([]uint64{1, 2}))
+		Expect(s.RunVisits(run2.ID)).To(Equal([]uint64{1}))
+
+		// Resume the first run.
+		s.UseRun(run1.ID)
+		Expect(s.IsVisited(2)).To(BeTrue())
+
+		Expect(s.DeleteRun(run1.ID)).To(BeNil())
+		Expect(s.RunVisits(run1.ID)).To(BeEmpty())
+		Expect(s.RunVisits(run2.ID)).To(Equal([]uint64{1}))
+		Expect(s.Get("http://example.org/1")).To(BeNil())
+		Expect(s.ListFailures()).To(BeEmpty())
+		Expect(s.Run(run1.ID)).To(BeNil())
+		Expect(s.Run(run2.ID)).NotTo(BeNil())
+	})
+
+	It("should key cached data and failures by run", func() {
+		s := collysqlite.NewStorage("test-db-" + randomName())
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		s.ScopeReadsToRun = true
+		u := "http://example.org/"
+
+		run1, err := s.StartRun("first", nil)
+		Expect(err).To(BeNil())
+		Expect(s.Put(u, []byte{1})).To(BeNil())
+		_, err = s.Failed(u, 0, errors.New("connection refused"))
+		Expect(err).To(BeNil())
+
+		run2, err := s.StartRun("second", nil)
+		Expect(err).To(BeNil())
+		Expect(s.Get(u)).To(BeNil())
+		Expect(s.Failure(u)).To(BeNil())
+		Expect(s.Put(u, []byte{2})).To(BeNil())
+		f, err := s.Failed(u, 0, errors.New("connection refused"))
+		Expect(err).To(BeNil())
+		Expect(f.Attempts).To(Equal(1))
+		Expect(s.ListFailures()).To(HaveLen(1))
+
+		s.UseRun(run1.ID)
+		Expect(s.Get(u)).To(Equal([]byte{1}))
+		Expect(s.ClearFailure(u)).To(BeNil())
+		Expect(s.ListFailures()).To(BeEmpty())
+		s.UseRun(run2.ID)
+		Expect(s.Get(u)).To(Equal([]byte{2}))
+		Expect(s.ListFailures()).To(HaveLen(1))
+	})
+
+	It("should read cached data of every run by default", func() {
+		s := collysqlite.NewStorage("test-db-" + randomName())
+		Expect(s.Init()).To(BeNil())
+		defer s.Destroy()
+		u := "http://example.org/"
+
+		_, err := s.StartRun("first", nil)
+		Expect(err).To(BeNil())
+		Expect(s.Put(u, []byte{1})).To(BeNil())
+
+		run2, err := s.StartRun("second", nil)
+		Expect(err).To(BeNil())
+		Expect(s.Get(u)).To(Equal([]byte{1}))
+		Expect(s.Put(u, []byte{2})).To(BeNil())
+		Expect(s.Get(u)).To(Equal([]byte{2}))
+
+		// Removal is from every run.
+		Expect(s.Remove(u)).To(BeNil())
+		Expect(s.Get(u)).To(BeNil())
+		Expect(s.Put(u, []byte{3})).To(BeNil())
+		Expect(s.DeleteRun(run2.ID)).To(BeNil())
+		Expect(s.Get(u)).To(BeNil())
+	})
+})
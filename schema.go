@@ -0,0 +1,104 @@
+package collysqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrSchemaTooNew is returned by Init when a database was written by
+// a newer version of this package, with a schema it does not understand.
+var ErrSchemaTooNew = errors.New("collysqlite: database schema is newer than supported")
+
+const (
+	createSchemaVersionDDL = `
+		CREATE TABLE IF NOT EXISTS schema_version (
+			name			TEXT NOT NULL,
+			version			INTEGER NOT NULL,
+			PRIMARY KEY (name)
+		);
+	`
+)
+
+// A migration is one step in the evolution of a store's schema.
+// Migrations are run in order, each in the same transaction as the
+// recording of its version, and must be safe to run on databases
+// created before versions were recorded.
+type migration func(ctx context.Context, tx *sqlx.Tx) error
+
+// execMigration returns a migration that executes ddl.
+func execMigration(ddl string) migration {
+	return func(ctx context.Context, tx *sqlx.Tx) error {
+		_, err := tx.ExecContext(ctx, ddl)
+		return err
+	}
+}
+
+// migrate brings the schema of the named store up to date, by running
+// those migrations that have not already been run. The store's version
+// is the number of migrations that have been run.
+func migrate(ctx context.Context, db *sqlx.DB, name string, migrations []migration) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, createSchemaVersionDDL)
+	if err != nil {
+		return err
+	}
+	version := 0
+	err = tx.GetContext(ctx, &version, "SELECT COALESCE(MAX(version), 0) FROM schema_version WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("%w: %s is version %d, this package supports version %d", ErrSchemaTooNew, name, version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+	for _, m := range migrations[version:] {
+		err = m(ctx, tx)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx, "INSERT OR REPLACE INTO schema_version (name, version) VALUES (?, ?)", name, len(migrations))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// forgetSchema removes the schema version of the named store,
+// and the schema_version table itself once it is empty.
+func forgetSchema(ctx context.Context, db *sqlx.DB, name string) error {
+	_, err := db.ExecContext(ctx, createSchemaVersionDDL)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "DELETE FROM schema_version WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	count := 0
+	err = db.GetContext(ctx, &count, "SELECT COUNT(*) FROM schema_version")
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err = db.ExecContext(ctx, "DROP TABLE schema_version")
+	return err
+}
+
+// hasColumn reports whether the given table has the given column.
+func hasColumn(ctx context.Context, tx *sqlx.Tx, table, column string) (bool, error) {
+	count := 0
+	err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column)
+	return count > 0, err
+}
@@ -0,0 +1,105 @@
+package collysqlite_test
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jimsmart/collysqlite"
+	"github.com/jmoiron/sqlx"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Schema", func() {
+
+	exec := func(path, query string, args ...interface{}) {
+		db, err := sqlx.Connect("sqlite3", path)
+		Expect(err).To(BeNil())
+		defer db.Close()
+		_, err = db.Exec(query, args...)
+		Expect(err).To(BeNil())
+	}
+
+	It("should migrate a cookie jar created before profiles", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewCookieJar(name)
+		exec(j.Path, `
+			CREATE TABLE cookie_jar (
+				host			TEXT NOT NULL UNIQUE,
+				cookies			TEXT NOT NULL,
+				modified_at		DATETIME,
+				created_at		DATETIME NOT NULL,
+				PRIMARY KEY (host)
+			);
+			CREATE INDEX idx_cookie_jar_created_at ON cookie_jar(created_at);
+			CREATE INDEX idx_cookie_jar_modified_at ON cookie_jar(modified_at);
+		`)
+		exec(j.Path, "INSERT INTO cookie_jar (host, cookies, created_at) VALUES (?, ?, ?)",
+			"example.org", "cookie1_name=cookie1_value", time.Now())
+
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+		// Init is idempotent.
+		Expect(j.Init()).To(BeNil())
+
+		u, _ := url.Parse("http://example.org")
+		got, err := j.Cookies(u)
+		Expect(err).To(BeNil())
+		Expect(toStrings(got)).To(Equal([]string{"cookie1_name=cookie1_value"}))
+		Expect(j.Profiles()).To(Equal([]string{""}))
+
+		j.Profile("alice").SetCookies(u, []*http.Cookie{
+			&http.Cookie{Name: "cookie2_name", Value: "cookie2_value"},
+		})
+		Expect(j.Profiles()).To(Equal([]string{"", "alice"}))
+	})
+
+	It("should migrate visits created before runs", func() {
+		name := "test-db-" + randomName()
+		t := collysqlite.NewVisitTracker(name)
+		exec(t.Path, `
+			CREATE TABLE visit (
+				id				INTEGER NOT NULL UNIQUE,
+				created_at		DATETIME NOT NULL,
+				PRIMARY KEY (id)
+			);
+			CREATE INDEX idx_visit_created_at ON visit(created_at);
+		`)
+		exec(t.Path, "INSERT INTO visit (id, created_at) VALUES (?, ?)", 12345, time.Now())
+
+		Expect(t.Init()).To(BeNil())
+		defer t.Destroy()
+		Expect(t.IsVisited(12345)).To(BeTrue())
+		t.RunID = 1
+		Expect(t.IsVisited(12345)).To(BeFalse())
+		Expect(t.Visited(12345)).To(BeNil())
+	})
+
+	It("should refuse a database from a newer version", func() {
+		name := "test-db-" + randomName()
+		c := collysqlite.NewCache(name)
+		Expect(c.Init()).To(BeNil())
+		defer c.Destroy()
+		exec(c.Path, "UPDATE schema_version SET version = version + 1 WHERE name = 'cache'")
+
+		err := c.Init()
+		Expect(err).To(MatchError(collysqlite.ErrSchemaTooNew))
+	})
+
+	It("should version stores sharing a database independently", func() {
+		name := "test-db-" + randomName()
+		c := collysqlite.NewCache(name)
+		t := collysqlite.NewVisitTracker(name)
+		t.Path = c.Path
+		Expect(c.Init()).To(BeNil())
+		Expect(t.Init()).To(BeNil())
+
+		Expect(c.Destroy()).To(BeNil())
+		Expect(c.Path).To(BeAnExistingFile())
+		Expect(t.Init()).To(BeNil())
+		Expect(t.Destroy()).To(BeNil())
+		Expect(c.Path).NotTo(BeAnExistingFile())
+	})
+})
@@ -1,7 +1,10 @@
 package collysqlite
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -21,12 +24,25 @@ type storage interface {
 }
 
 var _ storage = &Storage{}
+var _ queueStorage = &Storage{}
+var _ ContextIniter = &Storage{}
+var _ ContextDestroyer = &Storage{}
+var _ ContextCloser = &Storage{}
 
 type Storage struct {
 	Path string
+	// CheckpointTimeout bounds how long Checkpoint may hold off writers.
+	// Zero uses DefaultCheckpointTimeout.
+	CheckpointTimeout time.Duration
 	*VisitTracker
+	*Frontier
+	*LinkGraph
 	*ExplodingCookieJar
 	*Cache
+	*RobotsStore
+	*Queue
+	*Failures
+	*Runs
 }
 
 // TODO(js) Is Store a better name for Storage?
@@ -35,39 +51,126 @@ func NewStorage(path string) *Storage {
 	s := &Storage{
 		Path:               path,
 		VisitTracker:       NewVisitTracker(path + "-visits"),
+		Frontier:           NewFrontier(path + "-visits"),
+		LinkGraph:          NewLinkGraph(path + "-visits"),
 		ExplodingCookieJar: &ExplodingCookieJar{Jar: NewCookieJar(path + "-cookies")},
 		Cache:              NewCache(path + "-cache"),
+		RobotsStore:        NewRobotsStore(path + "-cache"),
+		Queue:              NewQueue(path + "-queue"),
+		Failures:           NewFailures(path + "-failures"),
+		Runs:               NewRuns(path + "-runs"),
 	}
 	return s
 }
 
+// components returns the stores that make up s.
+func (s *Storage) components() []interface{} {
+	return []interface{}{s.VisitTracker, s.Frontier, s.LinkGraph, s.ExplodingCookieJar, s.Cache, s.RobotsStore, s.Queue, s.Failures, s.Runs}
+}
+
+// Init initialises each component in turn. If a component fails to
+// initialise, it and those already initialised are rolled back: components
+// whose database did not exist before Init are destroyed, others are closed.
+// The returned error is a MultiError of the failure and any rollback errors.
 func (s *Storage) Init() error {
-	err := s.VisitTracker.Init()
-	if err != nil {
-		return err
+	return s.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (s *Storage) InitContext(ctx context.Context) error {
+	components := s.components()
+	// Components may share a database, so check them all first.
+	existed := make([]bool, len(components))
+	for i, c := range components {
+		existed[i] = databaseExists(c)
 	}
-	err = s.ExplodingCookieJar.Init()
-	if err != nil {
-		return err
+	for i, c := range components {
+		err := initIfIniter(ctx, c)
+		if err == nil {
+			continue
+		}
+		// Roll back with a fresh context, as ctx may be why Init failed.
+		rctx := context.Background()
+		errs := []error{err}
+		for j := i; j >= 0; j-- {
+			if j == i && !existed[j] && !databaseExists(c) {
+				// The failed component created nothing.
+				continue
+			}
+			if existed[j] {
+				errs = append(errs, closeIfCloser(rctx, components[j]))
+			} else {
+				errs = append(errs, destroyIfDestroyer(rctx, components[j]))
+			}
+		}
+		return newMultiError(errs)
 	}
-	return s.Cache.Init()
+	return nil
 }
 
+// Destroy destroys every component, returning a MultiError
+// of any that failed.
 func (s *Storage) Destroy() error {
-	err1 := s.VisitTracker.Destroy()
-	err2 := s.ExplodingCookieJar.Destroy()
-	err3 := s.Cache.Destroy()
-	// TODO(js) Is there some type of existing multi-error? If not, implement one.
-	if err1 != nil {
-		return err1
+	return s.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (s *Storage) DestroyContext(ctx context.Context) error {
+	var errs []error
+	for _, c := range s.components() {
+		errs = append(errs, destroyIfDestroyer(ctx, c))
 	}
-	if err2 != nil {
-		return err2
+	return newMultiError(errs)
+}
+
+// Close calls Close on each component that is a Closer,
+// returning a MultiError of any that failed.
+func (s *Storage) Close() error {
+	return s.CloseContext(context.Background())
+}
+
+// CloseContext is like Close but includes a context.
+func (s *Storage) CloseContext(ctx context.Context) error {
+	var errs []error
+	for _, c := range s.components() {
+		errs = append(errs, closeIfCloser(ctx, c))
+	}
+	return newMultiError(errs)
+}
+
+// databasePath returns the path of the database of component c.
+func databasePath(c interface{}) string {
+	switch c := c.(type) {
+	case *VisitTracker:
+		return c.Path
+	case *Frontier:
+		return c.Path
+	case *LinkGraph:
+		return c.Path
+	case *ExplodingCookieJar:
+		return c.Jar.Path
+	case *Cache:
+		return c.Path
+	case *RobotsStore:
+		return c.Path
+	case *Queue:
+		return c.Path
+	case *Failures:
+		return c.Path
+	case *Runs:
+		return c.Path
 	}
-	if err3 != nil {
-		return err3
+	return ""
+}
+
+// databaseExists reports whether the database file of component c exists.
+func databaseExists(c interface{}) bool {
+	path := databasePath(c)
+	if path == "" {
+		return false
 	}
-	return nil
+	_, err := os.Stat(path)
+	return err == nil
 }
 
 func (s *Storage) GetCookieJar() http.CookieJar {
@@ -1,6 +1,11 @@
 package collysqlite_test
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+
 	"github.com/jimsmart/collysqlite"
 
 	. "github.com/onsi/ginkgo"
@@ -16,12 +21,134 @@ var _ = Describe("Storage", func() {
 		filename1 := name + "-cookies.sqlite"
 		filename2 := name + "-visits.sqlite"
 		filename3 := name + "-cache.sqlite"
+		filename4 := name + "-queue.sqlite"
+		filename5 := name + "-failures.sqlite"
+		filename6 := name + "-runs.sqlite"
 		Expect(filename1).To(BeAnExistingFile())
 		Expect(filename2).To(BeAnExistingFile())
 		Expect(filename3).To(BeAnExistingFile())
+		Expect(filename4).To(BeAnExistingFile())
+		Expect(filename5).To(BeAnExistingFile())
+		Expect(filename6).To(BeAnExistingFile())
 		Expect(s.Destroy()).To(BeNil())
 		Expect(filename1).NotTo(BeAnExistingFile())
 		Expect(filename2).NotTo(BeAnExistingFile())
 		Expect(filename3).NotTo(BeAnExistingFile())
+		Expect(filename4).NotTo(BeAnExistingFile())
+		Expect(filename5).NotTo(BeAnExistingFile())
+		Expect(filename6).NotTo(BeAnExistingFile())
+	})
+
+	It("should forward Init, Close and Destroy to its components", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		store := &lifecycleCookieStore{CookieStore: collysqlite.NewMemoryCookieStore()}
+		s.ExplodingCookieJar.Jar.Store = store
+		Expect(s.Init()).To(BeNil())
+		Expect(s.Close()).To(BeNil())
+		Expect(s.Destroy()).To(BeNil())
+		Expect(store.calls).To(Equal([]string{"Init", "Close", "Destroy"}))
+	})
+
+	It("should roll back a failed Init", func() {
+		name := "test-db-" + randomName()
+		// Make an existing visits database, which must be kept.
+		t := collysqlite.NewVisitTracker(name + "-visits")
+		Expect(t.Init()).To(BeNil())
+		Expect(t.Visited(1)).To(BeNil())
+		defer t.Destroy()
+		// Make the cache fail, its directory is a file.
+		Expect(ioutil.WriteFile(name+"-file", nil, 0644)).To(BeNil())
+		defer os.Remove(name + "-file")
+
+		s := collysqlite.NewStorage(name)
+		s.Cache.Path = name + "-file/cache.sqlite"
+		err := s.Init()
+		Expect(err).NotTo(BeNil())
+		var m collysqlite.MultiError
+		Expect(errors.As(err, &m)).To(BeTrue())
+		Expect(name + "-cookies.sqlite").NotTo(BeAnExistingFile())
+		Expect(t.IsVisited(1)).To(BeTrue())
+	})
+
+	It("should roll back the component that failed to Init", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		s.ExplodingCookieJar.Jar.Store = &failingInitStore{collysqlite.NewSQLiteCookieStore(name + "-cookies")}
+		err := s.Init()
+		Expect(err).NotTo(BeNil())
+		var m collysqlite.MultiError
+		Expect(errors.As(err, &m)).To(BeTrue())
+		Expect(m).To(HaveLen(1))
+		Expect(name + "-cookies.sqlite").NotTo(BeAnExistingFile())
+		Expect(name + "-visits.sqlite").NotTo(BeAnExistingFile())
+	})
+
+	It("should not Init with a cancelled context", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(s.InitContext(ctx)).NotTo(BeNil())
+		Expect(name + "-visits.sqlite").NotTo(BeAnExistingFile())
+		Expect(s.InitContext(context.Background())).To(BeNil())
+		Expect(s.CloseContext(context.Background())).To(BeNil())
+		Expect(s.DestroyContext(context.Background())).To(BeNil())
+		Expect(name + "-visits.sqlite").NotTo(BeAnExistingFile())
+	})
+
+	It("should report every Destroy error", func() {
+		name := "test-db-" + randomName()
+		s := collysqlite.NewStorage(name)
+		Expect(s.Init()).To(BeNil())
+		defer os.Remove(name + "-visits.sqlite")
+		defer os.Remove(name + "-cache.sqlite")
+		s.VisitTracker.Path = name + "-missing/visits.sqlite"
+		s.Cache.Path = name + "-missing/cache.sqlite"
+		err := s.Destroy()
+		var m collysqlite.MultiError
+		Expect(errors.As(err, &m)).To(BeTrue())
+		Expect(m).To(HaveLen(2))
+		Expect(name + "-cookies.sqlite").NotTo(BeAnExistingFile())
 	})
 })
+
+// lifecycleCookieStore is a CookieStore that records
+// calls to its Init, Destroy and Close methods.
+type lifecycleCookieStore struct {
+	collysqlite.CookieStore
+	calls []string
+}
+
+func (s *lifecycleCookieStore) Init() error {
+	s.calls = append(s.calls, "Init")
+	return s.CookieStore.Init()
+}
+
+func (s *lifecycleCookieStore) Destroy() error {
+	s.calls = append(s.calls, "Destroy")
+	return s.CookieStore.Destroy()
+}
+
+func (s *lifecycleCookieStore) Close() error {
+	s.calls = append(s.calls, "Close")
+	return nil
+}
+
+// failingInitStore is an SQLiteCookieStore whose Init fails
+// after creating its database.
+type failingInitStore struct {
+	*collysqlite.SQLiteCookieStore
+}
+
+func (s *failingInitStore) Init() error {
+	return s.InitContext(context.Background())
+}
+
+func (s *failingInitStore) InitContext(ctx context.Context) error {
+	err := s.SQLiteCookieStore.InitContext(ctx)
+	if err != nil {
+		return err
+	}
+	return errors.New("init failed")
+}
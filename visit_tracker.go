@@ -1,6 +1,8 @@
 package collysqlite
 
 import (
+	"context"
+	"sort"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -15,14 +17,36 @@ const (
 		);
 		CREATE INDEX IF NOT EXISTS idx_visit_created_at ON visit(created_at);
 	`
+	// addVisitRunDDL rebuilds the table with a run_id column,
+	// which becomes part of the primary key.
+	addVisitRunDDL = `
+		CREATE TABLE visit_new (
+			run_id			INTEGER NOT NULL DEFAULT 0,
+			id				INTEGER NOT NULL,
+			created_at		DATETIME NOT NULL,
+			PRIMARY KEY (run_id, id)
+		);
+		INSERT INTO visit_new (id, created_at) SELECT id, created_at FROM visit;
+		DROP TABLE visit;
+		ALTER TABLE visit_new RENAME TO visit;
+		CREATE INDEX IF NOT EXISTS idx_visit_created_at ON visit(created_at);
+	`
 	dropVisitDDL = `
 		DROP INDEX IF EXISTS idx_visit_created_at;
 		DROP TABLE IF EXISTS visit;
 	`
 )
 
+// visitMigrations are the steps that create and upgrade the visit schema.
+var visitMigrations = []migration{
+	execMigration(createVisitDDL),
+	execMigration(addVisitRunDDL),
+}
+
 type visitRecord struct {
-	ID        uint64    `db:"id"`
+	RunID int64 `db:"run_id"`
+	// ID is the request ID's bit pattern, as SQLite has no unsigned integers.
+	ID        int64     `db:"id"`
 	CreatedAt time.Time `db:"created_at"`
 }
 
@@ -45,6 +69,9 @@ var _ visitTracker = &VisitTracker{}
 
 type VisitTracker struct {
 	Path string
+	// RunID, if set, is the Run that visits are recorded in and checked
+	// against. Each run has its own visits, see Runs.
+	RunID int64
 }
 
 func NewVisitTracker(path string) *VisitTracker {
@@ -55,64 +82,136 @@ func NewVisitTracker(path string) *VisitTracker {
 }
 
 func (t *VisitTracker) Init() error {
+	return t.InitContext(context.Background())
+}
+
+// InitContext is like Init but includes a context.
+func (t *VisitTracker) InitContext(ctx context.Context) error {
 	err := ensurePathExists(t.Path)
 	if err != nil {
 		return err
 	}
-	db, err := t.connect()
+	db, err := t.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(createVisitDDL)
-	return err
+	return migrate(ctx, db, "visit", visitMigrations)
 }
 
 func (t *VisitTracker) Destroy() error {
-	db, err := t.connect()
+	return t.DestroyContext(context.Background())
+}
+
+// DestroyContext is like Destroy but includes a context.
+func (t *VisitTracker) DestroyContext(ctx context.Context) error {
+	db, err := t.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	_, err = db.Exec(dropVisitDDL)
+	_, err = db.ExecContext(ctx, dropVisitDDL)
 	if err != nil {
 		return err
 	}
-	return removeIfNoTables(db, t.Path)
+	err = forgetSchema(ctx, db, "visit")
+	if err != nil {
+		return err
+	}
+	return removeIfNoTables(ctx, db, t.Path)
 }
 
 func (t *VisitTracker) Visited(requestID uint64) error {
+	return t.VisitedContext(context.Background(), requestID)
+}
+
+// VisitedContext is like Visited but includes a context.
+func (t *VisitTracker) VisitedContext(ctx context.Context, requestID uint64) error {
 	// TODO(js) The API would be better without an opaque ID going across the boundary,
 	// it should just be a url string, and the tracker implementation should decide how best to store it.
-	db, err := t.connect()
+	db, err := t.connect(ctx)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 	r := &visitRecord{
-		ID:        requestID,
+		RunID:     t.RunID,
+		ID:        int64(requestID),
 		CreatedAt: time.Now(),
 	}
-	_, err = db.NamedExec("INSERT INTO visit (id, created_at) VALUES (:id, :created_at)", r)
+	_, err = db.NamedExecContext(ctx, "INSERT INTO visit (run_id, id, created_at) VALUES (:run_id, :id, :created_at)", r)
 	return err
 }
 
 func (t *VisitTracker) IsVisited(requestID uint64) (bool, error) {
+	return t.IsVisitedContext(context.Background(), requestID)
+}
+
+// IsVisitedContext is like IsVisited but includes a context.
+func (t *VisitTracker) IsVisitedContext(ctx context.Context, requestID uint64) (bool, error) {
 	// TODO(js) The API would be better without an opaque ID going across the boundary,
 	// it should just be a url string, and the tracker implementation should decide how best to store it.
-	db, err := t.connect()
+	db, err := t.connect(ctx)
 	if err != nil {
 		return false, err
 	}
 	defer db.Close()
 	var count int
-	err = db.Get(&count, "SELECT COUNT(id) FROM visit WHERE id = ?", requestID)
+	err = db.GetContext(ctx, &count, "SELECT COUNT(id) FROM visit WHERE run_id = ? AND id = ?", t.RunID, int64(requestID))
 	if err != nil {
 		return false, err
 	}
 	return count == 1, nil
 }
 
-func (t *VisitTracker) connect() (*sqlx.DB, error) {
-	return sqlx.Connect("sqlite3", t.Path)
+// RunVisits returns the request IDs visited in the given run,
+// such as to compare runs.
+func (t *VisitTracker) RunVisits(runID int64) ([]uint64, error) {
+	return t.RunVisitsContext(context.Background(), runID)
+}
+
+// RunVisitsContext is like RunVisits but includes a context.
+func (t *VisitTracker) RunVisitsContext(ctx context.Context, runID int64) ([]uint64, error) {
+	db, err := t.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	var rows []int64
+	err = db.SelectContext(ctx, &rows, "SELECT id FROM visit WHERE run_id = ?", runID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]uint64, len(rows))
+	for i, id := range rows {
+		ids[i] = uint64(id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (t *VisitTracker) deleteRun(ctx context.Context, runID int64) error {
+	db, err := t.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.ExecContext(ctx, "DELETE FROM visit WHERE run_id = ?", runID)
+	return err
+}
+
+// Backup copies the database to a new file at destPath, replacing any
+// existing file, reporting progress to progress, if not nil.
+// It is safe to call while the tracker is in use.
+func (t *VisitTracker) Backup(destPath string, progress func(BackupProgress)) error {
+	return t.BackupContext(context.Background(), destPath, progress)
+}
+
+// BackupContext is like Backup but includes a context.
+func (t *VisitTracker) BackupContext(ctx context.Context, destPath string, progress func(BackupProgress)) error {
+	return backupDatabase(ctx, t.Path, destPath, progress)
+}
+
+func (t *VisitTracker) connect(ctx context.Context) (*sqlx.DB, error) {
+	return sqlx.ConnectContext(ctx, "sqlite3", t.Path)
 }
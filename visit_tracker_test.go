@@ -1,6 +1,7 @@
 package collysqlite_test
 
 import (
+	"context"
 	"github.com/jimsmart/collysqlite"
 
 	. "github.com/onsi/ginkgo"
@@ -61,4 +62,38 @@ var _ = Describe("VisitTracker", func() {
 		Expect(got).To(BeFalse())
 	})
 
+	It("should track request IDs with the high bit set", func() {
+		name := "test-db-" + randomName()
+		j := collysqlite.NewVisitTracker(name)
+		Expect(j.Init()).To(BeNil())
+		defer j.Destroy()
+
+		id := uint64(1<<63 | 1)
+		Expect(j.Visited(id)).To(BeNil())
+		Expect(j.Visited(2)).To(BeNil())
+		got, err := j.IsVisited(id)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeTrue())
+		ids, err := j.RunVisits(0)
+		Expect(err).To(BeNil())
+		Expect(ids).To(Equal([]uint64{2, id}))
+	})
+
+	It("should honour a cancelled context", func() {
+		name := "test-db-" + randomName()
+		t := collysqlite.NewVisitTracker(name)
+		Expect(t.InitContext(context.Background())).To(BeNil())
+		defer t.Destroy()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		Expect(t.VisitedContext(ctx, 12345)).To(BeNil())
+		got, err := t.IsVisitedContext(ctx, 12345)
+		Expect(err).To(BeNil())
+		Expect(got).To(BeTrue())
+		cancel()
+		Expect(t.VisitedContext(ctx, 123)).To(MatchError(context.Canceled))
+		_, err = t.IsVisitedContext(ctx, 12345)
+		Expect(err).To(MatchError(context.Canceled))
+	})
+
 })